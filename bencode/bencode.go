@@ -0,0 +1,87 @@
+// Package bencode implements the encoding used by .torrent files, tracker
+// responses and peer extension messages.
+//
+// Go values map to bencode much like they do in encoding/json: integers
+// and bools become integers, strings and byte slices become strings,
+// slices and arrays become lists, and maps and structs become dictionaries.
+// Struct fields are named with a `bencode:"name,omitempty"` tag.
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RawMessage is a raw bencoded value. It can be used to keep the exact
+// bytes of a sub-dictionary, e.g. to compute a torrent's info hash, or to
+// delay decoding.
+type RawMessage []byte
+
+// MarshalBencode returns m as the bencoding of m
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, errors.New("bencode: cannot encode empty RawMessage")
+	}
+	return m, nil
+}
+
+// UnmarshalBencode sets *m to a copy of data
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+type structFields struct {
+	byName map[string]field
+	sorted []field // in canonical (byte-wise) key order
+}
+
+var fieldCache sync.Map // map[reflect.Type]*structFields
+
+// cachedFields lists the exported fields of a struct type along with the
+// dictionary keys they're stored under
+func cachedFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+
+	fields := &structFields{byName: map[string]field{}}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" { // unexported
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name := sf.Name
+		opts := strings.Split(tag, ",")
+		if opts[0] != "" {
+			name = opts[0]
+		}
+		f := field{name: name, index: i}
+		for _, opt := range opts[1:] {
+			if opt == "omitempty" {
+				f.omitEmpty = true
+			}
+		}
+		fields.byName[name] = f
+		fields.sorted = append(fields.sorted, f)
+	}
+	sort.Slice(fields.sorted, func(i, j int) bool {
+		return fields.sorted[i].name < fields.sorted[j].name
+	})
+
+	f, _ := fieldCache.LoadOrStore(t, fields)
+	return f.(*structFields)
+}
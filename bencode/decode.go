@@ -0,0 +1,551 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// maxDepth limits how deeply lists and dictionaries may be nested, so
+// hostile input can't exhaust the stack
+const maxDepth = 1000
+
+// Unmarshaler is implemented by types that decode their own bencoded form.
+// The input is exactly one complete bencoded value.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+// A SyntaxError describes malformed bencode and where it was found
+type SyntaxError struct {
+	msg    string
+	Offset int64 // byte offset in the input where the error was detected
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+// An UnmarshalTypeError describes a bencoded value that can't be stored
+// in a Go value of the given type
+type UnmarshalTypeError struct {
+	Value  string       // "integer", "string", "list" or "dictionary"
+	Type   reflect.Type // type of the Go value it could not be assigned to
+	Offset int64        // byte offset of the value in the input
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// Unmarshal parses exactly one bencoded value from data and stores the
+// result in the value pointed to by v.
+func Unmarshal(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	err := d.Decode(v)
+	if err == io.EOF {
+		return &SyntaxError{"unexpected end of input", 0}
+	}
+	if err != nil {
+		return err
+	}
+	if d.off != int64(len(data)) {
+		return &SyntaxError{"trailing data after value", d.off}
+	}
+	return nil
+}
+
+// A Decoder reads and decodes bencoded values from a stream
+type Decoder struct {
+	r       *bufio.Reader
+	off     int64
+	strict  bool
+	depth   int
+	capture *bytes.Buffer // receives every consumed byte while non-nil
+}
+
+// NewDecoder returns a Decoder that reads from r.
+// The Decoder buffers its input and may read past the values it returns.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Strict makes the Decoder reject input that isn't in canonical form:
+// dictionary keys must be unique and sorted, and neither integers nor
+// string lengths may have leading zeros or be negative zero.
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// InputOffset returns the number of bytes consumed by the Decoder so far
+func (d *Decoder) InputOffset() int64 {
+	return d.off
+}
+
+// Decode reads the next bencoded value from its input and stores it in the
+// value pointed to by v. Returns io.EOF if the input ends before a value
+// starts.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("bencode: Decode requires a non-nil pointer")
+	}
+	return d.value(rv.Elem())
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	d.off++
+	if d.capture != nil {
+		d.capture.WriteByte(c)
+	}
+	return c, nil
+}
+
+func (d *Decoder) unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return &SyntaxError{"unexpected end of input", d.off}
+	}
+	return err
+}
+
+// value decodes the next value into v. An invalid v discards the value.
+func (d *Decoder) value(v reflect.Value) error {
+	start := d.off
+	c, err := d.readByte()
+	if err != nil {
+		if err == io.EOF && d.depth == 0 {
+			return io.EOF
+		}
+		return d.unexpectedEOF(err)
+	}
+
+	if v.IsValid() {
+		u, pv := indirect(v)
+		if u != nil {
+			return d.unmarshaler(u, c, start)
+		}
+		v = pv
+	}
+	return d.literal(v, c, start)
+}
+
+// literal decodes the value whose first byte c was already consumed
+func (d *Decoder) literal(v reflect.Value, c byte, start int64) error {
+	switch {
+	case c == 'i':
+		return d.integer(v, start)
+	case c >= '0' && c <= '9':
+		return d.str(v, c, start)
+	case c == 'l':
+		return d.list(v, start)
+	case c == 'd':
+		return d.dict(v, start)
+	default:
+		return &SyntaxError{fmt.Sprintf("invalid character %q looking for beginning of value", c), start}
+	}
+}
+
+// unmarshaler hands the raw bytes of the value starting with c to u
+func (d *Decoder) unmarshaler(u Unmarshaler, c byte, start int64) error {
+	outer := d.capture
+	d.capture = bytes.NewBuffer([]byte{c})
+	err := d.literal(reflect.Value{}, c, start)
+	raw := d.capture.Bytes()
+	d.capture = outer
+	if outer != nil {
+		outer.Write(raw[1:]) // outer already saw the first byte
+	}
+	if err != nil {
+		return err
+	}
+	return u.UnmarshalBencode(raw)
+}
+
+// indirect walks down v through pointers, allocating them as needed,
+// and stops early at anything implementing Unmarshaler
+func indirect(v reflect.Value) (Unmarshaler, reflect.Value) {
+	for {
+		if v.Kind() != reflect.Ptr && v.CanAddr() {
+			if u, ok := v.Addr().Interface().(Unmarshaler); ok {
+				return u, v
+			}
+		}
+		if v.Kind() != reflect.Ptr {
+			return nil, v
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if u, ok := v.Interface().(Unmarshaler); ok {
+			return u, v
+		}
+		v = v.Elem()
+	}
+}
+
+// readUntil reads up to and including delim, returning what came before it
+func (d *Decoder) readUntil(delim byte) ([]byte, error) {
+	var buf []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return nil, d.unexpectedEOF(err)
+		}
+		if c == delim {
+			return buf, nil
+		}
+		buf = append(buf, c)
+		if len(buf) > 20 {
+			return nil, &SyntaxError{"number too long", d.off}
+		}
+	}
+}
+
+// parseInt parses the digits of an integer or a string length
+func (d *Decoder) parseInt(digits []byte, start int64) (int64, error) {
+	s := string(digits)
+	if s == "" {
+		return 0, &SyntaxError{"empty number", start}
+	}
+	body := s
+	if body[0] == '-' {
+		body = body[1:]
+	}
+	if body == "" {
+		return 0, &SyntaxError{"invalid number " + strconv.Quote(s), start}
+	}
+	for i := 0; i < len(body); i++ {
+		if body[i] < '0' || body[i] > '9' {
+			return 0, &SyntaxError{"invalid number " + strconv.Quote(s), start}
+		}
+	}
+	if d.strict {
+		if len(body) > 1 && body[0] == '0' {
+			return 0, &SyntaxError{"leading zero in number " + strconv.Quote(s), start}
+		}
+		if s == "-0" {
+			return 0, &SyntaxError{"negative zero", start}
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, &SyntaxError{"number out of range " + strconv.Quote(s), start}
+	}
+	return n, nil
+}
+
+func (d *Decoder) integer(v reflect.Value, start int64) error {
+	digits, err := d.readUntil('e')
+	if err != nil {
+		return err
+	}
+	n, err := d.parseInt(digits, start+1)
+	if err != nil {
+		return err
+	}
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(n) {
+			return &UnmarshalTypeError{"integer " + strconv.FormatInt(n, 10), v.Type(), start}
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return &UnmarshalTypeError{"integer " + strconv.FormatInt(n, 10), v.Type(), start}
+		}
+		v.SetUint(uint64(n))
+	case reflect.Bool:
+		v.SetBool(n != 0)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return &UnmarshalTypeError{"integer", v.Type(), start}
+		}
+		v.Set(reflect.ValueOf(n))
+	default:
+		return &UnmarshalTypeError{"integer", v.Type(), start}
+	}
+	return nil
+}
+
+// readString reads a string whose first length digit is first
+func (d *Decoder) readString(first byte, start int64) ([]byte, error) {
+	digits, err := d.readUntil(':')
+	if err != nil {
+		return nil, err
+	}
+	n, err := d.parseInt(append([]byte{first}, digits...), start)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, &SyntaxError{"negative string length", start}
+	}
+
+	// Copy rather than preallocate, so a bogus length can't make us
+	// allocate more memory than the input actually holds
+	var buf bytes.Buffer
+	copied, err := io.CopyN(&buf, d.r, n)
+	d.off += copied
+	if d.capture != nil {
+		d.capture.Write(buf.Bytes())
+	}
+	if err != nil {
+		return nil, d.unexpectedEOF(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *Decoder) str(v reflect.Value, first byte, start int64) error {
+	s, err := d.readString(first, start)
+	if err != nil {
+		return err
+	}
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(s))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return &UnmarshalTypeError{"string", v.Type(), start}
+		}
+		v.SetBytes(s)
+	case reflect.Array:
+		if v.Type().Elem().Kind() != reflect.Uint8 || v.Len() != len(s) {
+			return &UnmarshalTypeError{"string", v.Type(), start}
+		}
+		reflect.Copy(v, reflect.ValueOf(s))
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return &UnmarshalTypeError{"string", v.Type(), start}
+		}
+		v.Set(reflect.ValueOf(string(s)))
+	default:
+		return &UnmarshalTypeError{"string", v.Type(), start}
+	}
+	return nil
+}
+
+// more reports whether a list or dictionary has another item, consuming
+// the terminating 'e' if it doesn't
+func (d *Decoder) more() (bool, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return false, d.unexpectedEOF(err)
+	}
+	if b[0] != 'e' {
+		return true, nil
+	}
+	_, err = d.readByte()
+	return false, err
+}
+
+func (d *Decoder) enter(start int64) error {
+	d.depth++
+	if d.depth > maxDepth {
+		return &SyntaxError{"exceeded max depth", start}
+	}
+	return nil
+}
+
+func (d *Decoder) list(v reflect.Value, start int64) error {
+	err := d.enter(start)
+	if err != nil {
+		return err
+	}
+	defer func() { d.depth-- }()
+
+	if v.IsValid() {
+		switch v.Kind() {
+		case reflect.Slice:
+			v.SetLen(0)
+		case reflect.Array:
+		case reflect.Interface:
+			if v.NumMethod() != 0 {
+				return &UnmarshalTypeError{"list", v.Type(), start}
+			}
+			var items []interface{}
+			for i := 0; ; i++ {
+				more, err := d.more()
+				if err != nil {
+					return err
+				}
+				if !more {
+					break
+				}
+				var item interface{}
+				err = d.value(reflect.ValueOf(&item).Elem())
+				if err != nil {
+					return err
+				}
+				items = append(items, item)
+			}
+			if items == nil {
+				items = []interface{}{}
+			}
+			v.Set(reflect.ValueOf(items))
+			return nil
+		default:
+			return &UnmarshalTypeError{"list", v.Type(), start}
+		}
+	}
+
+	i := 0
+	for ; ; i++ {
+		more, err := d.more()
+		if err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+
+		elem := reflect.Value{}
+		if v.IsValid() {
+			if v.Kind() == reflect.Slice {
+				if i >= v.Cap() {
+					grown := reflect.MakeSlice(v.Type(), v.Len(), 2*v.Cap()+4)
+					reflect.Copy(grown, v)
+					v.Set(grown)
+				}
+				v.SetLen(i + 1)
+				elem = v.Index(i)
+				elem.Set(reflect.Zero(elem.Type()))
+			} else if i < v.Len() {
+				elem = v.Index(i)
+			}
+		}
+		err = d.value(elem)
+		if err != nil {
+			return err
+		}
+	}
+
+	if v.IsValid() {
+		switch v.Kind() {
+		case reflect.Slice:
+			if v.IsNil() {
+				v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+			}
+		case reflect.Array:
+			for ; i < v.Len(); i++ {
+				v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) dict(v reflect.Value, start int64) error {
+	err := d.enter(start)
+	if err != nil {
+		return err
+	}
+	defer func() { d.depth-- }()
+
+	var fields map[string]field
+	if v.IsValid() {
+		switch v.Kind() {
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return &UnmarshalTypeError{"dictionary", v.Type(), start}
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+		case reflect.Struct:
+			fields = cachedFields(v.Type()).byName
+		case reflect.Interface:
+			if v.NumMethod() != 0 {
+				return &UnmarshalTypeError{"dictionary", v.Type(), start}
+			}
+			m := map[string]interface{}{}
+			err := d.entries(func(key string) error {
+				var item interface{}
+				err := d.value(reflect.ValueOf(&item).Elem())
+				m[key] = item
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(m))
+			return nil
+		default:
+			return &UnmarshalTypeError{"dictionary", v.Type(), start}
+		}
+	}
+
+	return d.entries(func(key string) error {
+		if !v.IsValid() {
+			return d.value(reflect.Value{})
+		}
+		switch v.Kind() {
+		case reflect.Map:
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err := d.value(elem)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+			return nil
+		default:
+			f, ok := fields[key]
+			if !ok {
+				return d.value(reflect.Value{})
+			}
+			return d.value(v.Field(f.index))
+		}
+	})
+}
+
+// entries reads dictionary keys until the end of the dictionary, calling
+// onKey to consume each value
+func (d *Decoder) entries(onKey func(key string) error) error {
+	var prev []byte
+	for i := 0; ; i++ {
+		more, err := d.more()
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+
+		keyStart := d.off
+		c, err := d.readByte()
+		if err != nil {
+			return d.unexpectedEOF(err)
+		}
+		if c < '0' || c > '9' {
+			return &SyntaxError{fmt.Sprintf("invalid character %q looking for dictionary key", c), keyStart}
+		}
+		key, err := d.readString(c, keyStart)
+		if err != nil {
+			return err
+		}
+		if d.strict && i > 0 && bytes.Compare(prev, key) >= 0 {
+			return &SyntaxError{"dictionary key " + strconv.Quote(string(key)) + " out of order", keyStart}
+		}
+		prev = key
+
+		err = onKey(string(key))
+		if err != nil {
+			return err
+		}
+	}
+}
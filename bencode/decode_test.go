@@ -0,0 +1,181 @@
+package bencode
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testInfo struct {
+	Length      int      `bencode:"length"`
+	Name        string   `bencode:"name"`
+	PieceLength int      `bencode:"piece length"`
+	Private     bool     `bencode:"private"`
+	Path        []string `bencode:"path"`
+}
+
+type testTorrent struct {
+	Announce string     `bencode:"announce"`
+	Info     RawMessage `bencode:"info"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output interface{}
+		fails  bool
+	}{
+		"integer": {
+			input:  "i-42e",
+			output: int64(-42),
+		},
+		"string": {
+			input:  "5:hello",
+			output: "hello",
+		},
+		"empty string": {
+			input:  "0:",
+			output: "",
+		},
+		"list": {
+			input:  "li1e3:abce",
+			output: []interface{}{int64(1), "abc"},
+		},
+		"dictionary": {
+			input:  "d1:ai1e1:bl0:ee",
+			output: map[string]interface{}{"a": int64(1), "b": []interface{}{""}},
+		},
+		"unterminated list": {
+			input: "li1e",
+			fails: true,
+		},
+		"string longer than input": {
+			input: "10:abc",
+			fails: true,
+		},
+		"non-string key": {
+			input: "di1ei2ee",
+			fails: true,
+		},
+		"invalid integer": {
+			input: "i1x2e",
+			fails: true,
+		},
+		"trailing data": {
+			input: "i1ei2e",
+			fails: true,
+		},
+		"empty input": {
+			input: "",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		var v interface{}
+		err := Unmarshal([]byte(test.input), &v)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, v, name)
+	}
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	input := "d6:lengthi10e4:name5:a.txt6:md5sum3:xyz4:pathl1:a1:be12:piece lengthi16384e7:privatei1ee"
+	var info testInfo
+	err := Unmarshal([]byte(input), &info)
+	require.Nil(t, err)
+	assert.Equal(t, testInfo{
+		Length:      10,
+		Name:        "a.txt",
+		PieceLength: 16384,
+		Private:     true,
+		Path:        []string{"a", "b"},
+	}, info)
+}
+
+func TestUnmarshalTypeError(t *testing.T) {
+	var info testInfo
+	err := Unmarshal([]byte("d6:length3:abce"), &info)
+	require.NotNil(t, err)
+	typeErr, ok := err.(*UnmarshalTypeError)
+	require.True(t, ok)
+	assert.Equal(t, int64(9), typeErr.Offset)
+}
+
+func TestRawMessage(t *testing.T) {
+	info := "d4:name1:a7:privatei1e6:sourcel1:x1:yee"
+	input := "d8:announce3:url4:info" + info + "7:unknowni5ee"
+	var to testTorrent
+	err := Unmarshal([]byte(input), &to)
+	require.Nil(t, err)
+	assert.Equal(t, "url", to.Announce)
+	assert.Equal(t, info, string(to.Info))
+
+	out, err := Marshal(to)
+	require.Nil(t, err)
+	assert.Equal(t, "d8:announce3:url4:info"+info+"e", string(out))
+}
+
+func TestStrict(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		offset int64
+	}{
+		"unsorted keys": {
+			input:  "d1:bi1e1:ai2ee",
+			offset: 7,
+		},
+		"duplicate keys": {
+			input:  "d1:ai1e1:ai2ee",
+			offset: 7,
+		},
+		"leading zero in integer": {
+			input:  "i03e",
+			offset: 1,
+		},
+		"negative zero": {
+			input:  "i-0e",
+			offset: 1,
+		},
+		"leading zero in string length": {
+			input:  "li1e02:abe",
+			offset: 4,
+		},
+	}
+
+	for name, test := range tests {
+		var v interface{}
+		err := Unmarshal([]byte(test.input), &v)
+		assert.Nil(t, err, name)
+
+		d := NewDecoder(strings.NewReader(test.input))
+		d.Strict()
+		err = d.Decode(&v)
+		require.NotNil(t, err, name)
+		syntaxErr, ok := err.(*SyntaxError)
+		require.True(t, ok, name)
+		assert.Equal(t, test.offset, syntaxErr.Offset, name)
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i1e3:abcd1:xi2ee"))
+	var n int
+	var s string
+	var m map[string]int
+	require.Nil(t, d.Decode(&n))
+	assert.Equal(t, int64(3), d.InputOffset())
+	require.Nil(t, d.Decode(&s))
+	require.Nil(t, d.Decode(&m))
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "abc", s)
+	assert.Equal(t, map[string]int{"x": 2}, m)
+	assert.Equal(t, io.EOF, d.Decode(&n))
+}
@@ -0,0 +1,91 @@
+package bencode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := map[string]struct {
+		input  interface{}
+		output string
+		fails  bool
+	}{
+		"integer": {
+			input:  -42,
+			output: "i-42e",
+		},
+		"bool": {
+			input:  true,
+			output: "i1e",
+		},
+		"string": {
+			input:  "hello",
+			output: "5:hello",
+		},
+		"byte array": {
+			input:  [3]byte{'a', 'b', 'c'},
+			output: "3:abc",
+		},
+		"list": {
+			input:  []interface{}{1, "a"},
+			output: "li1e1:ae",
+		},
+		"map keys are sorted": {
+			input:  map[string]int{"b": 2, "a": 1, "ab": 3},
+			output: "d1:ai1e2:abi3e1:bi2ee",
+		},
+		"struct fields are sorted": {
+			input: testInfo{
+				Length:      10,
+				Name:        "a.txt",
+				PieceLength: 16384,
+				Path:        []string{"a"},
+			},
+			output: "d6:lengthi10e4:name5:a.txt4:pathl1:ae12:piece lengthi16384e7:privatei0ee",
+		},
+		"omitempty": {
+			input: struct {
+				A int    `bencode:"a,omitempty"`
+				B string `bencode:"b,omitempty"`
+				C int    `bencode:"c"`
+				D int    `bencode:"-"`
+			}{D: 4},
+			output: "d1:ci0ee",
+		},
+		"unsupported type": {
+			input: 1.5,
+			fails: true,
+		},
+		"invalid raw message": {
+			input: RawMessage("i1"),
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		out, err := Marshal(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, string(out), name)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	input := testInfo{Length: 3, Name: "x", PieceLength: 1, Private: true, Path: []string{"a", "b"}}
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).Encode(input)
+	assert.Nil(t, err)
+
+	var output testInfo
+	d := NewDecoder(&buf)
+	d.Strict()
+	err = d.Decode(&output)
+	assert.Nil(t, err)
+	assert.Equal(t, input, output)
+}
@@ -5,6 +5,11 @@ package bitfield
 // they are able to send us.
 type Bitfield []byte
 
+// New returns an empty Bitfield large enough for numPieces pieces
+func New(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
 // HasPiece tells if a Bitfield has a particular index
 func (b Bitfield) HasPiece(index int) bool {
 	// Bitfield looks like a byte array (grid).
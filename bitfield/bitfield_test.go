@@ -48,3 +48,19 @@ func TestSetPiece(t *testing.T) {
 		assert.Equal(t, test.output, bf)
 	}
 }
+
+func TestNew(t *testing.T) {
+	tests := map[string]struct {
+		numPieces int
+		output    Bitfield
+	}{
+		"no pieces":       {numPieces: 0, output: Bitfield{}},
+		"partial byte":    {numPieces: 3, output: Bitfield{0}},
+		"whole bytes":     {numPieces: 16, output: Bitfield{0, 0}},
+		"one spare piece": {numPieces: 17, output: Bitfield{0, 0, 0}},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, New(test.numPieces), name)
+	}
+}
@@ -2,8 +2,10 @@ package client
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/cedrickchee/min-torrent/bitfield"
@@ -13,16 +15,34 @@ import (
 )
 
 type Client struct {
-	Conn     net.Conn
-	Bitfield bitfield.Bitfield
-	Choked   bool
+	Conn       net.Conn
+	Bitfield   bitfield.Bitfield
+	Choked     bool
+	Extensions bool // the peer supports the extension protocol (BEP 10)
+
+	numPieces int        // pieces in the torrent, which Bitfield is sized for
+	writeMu   sync.Mutex // messages may be sent from several goroutines
+	out       *writer    // queues messages once started
+	readBuf   []byte     // bytes of the next message received so far
 }
 
+// Handler handles a message read from the peer; nil is a keep-alive.
+// Returning an error ends the read loop.
+type Handler func(msg *message.Message) error
+
+// readChunk is how much room is made for each read from the connection
+const readChunk = 32 * 1024
+
+// readTimeout is how long a peer may stay silent before Run gives up.
+// Peers send keep-alives every two minutes.
+const readTimeout = 3 * time.Minute
+
 func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Handshake, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // disable the deadline
 
 	req := handshake.New(infoHash, peerID)
+	req.EnableExtensions()
 	_, err := conn.Write(req.Serialize())
 	if err != nil {
 		return nil, err
@@ -38,25 +58,11 @@ func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Han
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{}) // disable the deadline
-
-	msg, err := message.Read(conn)
-	if err != nil {
-		return nil, err
-	}
-	if msg.ID != message.MsgBitfield {
-		err := fmt.Errorf("Expected bitfield but got ID %d", msg.ID)
-		return nil, err
-	}
-
-	return msg.Payload, nil
-}
-
 // New connects with a peer, completes a handshake, and receives a handshake.
-// Returns an err if any of those fail.
-func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
+// Returns an err if any of those fail. The peer's bitfield starts out
+// empty, sized for numPieces: peers with no pieces may not send one, so it
+// is handled by SetBitfield like any other message.
+func New(peer peers.Peer, peerID, infoHash [20]byte, numPieces int) (*Client, error) {
 	// Connect
 	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
 	if err != nil {
@@ -64,63 +70,204 @@ func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
 	}
 
 	// Handshake
-	_, err = completeHandshake(conn, infoHash, peerID)
+	res, err := completeHandshake(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	// Get bitfield
-	bf, err := recvBitfield(conn)
+	return &Client{
+		Conn:       conn,
+		Bitfield:   bitfield.New(numPieces),
+		Choked:     true,
+		Extensions: res.SupportsExtensions(),
+		numPieces:  numPieces,
+	}, nil
+}
+
+// Accept takes over an incoming connection whose handshake, remote, has
+// already been read. It replies with our handshake and our bitfield, bf.
+// Returns an err if either fails. As with New, the peer's bitfield starts
+// out empty, sized for numPieces.
+func Accept(conn net.Conn, remote *handshake.Handshake, peerID, infoHash [20]byte, bf bitfield.Bitfield, numPieces int) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	res := handshake.New(infoHash, peerID)
+	res.EnableExtensions()
+	_, err := conn.Write(res.Serialize())
+	if err != nil {
+		return nil, err
+	}
+	msg := message.Message{ID: message.MsgBitfield, Payload: bf}
+	_, err = conn.Write(msg.Serialize())
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{}) // disable the deadline
 
 	return &Client{
-		Conn:     conn,
-		Bitfield: bf,
-		Choked:   true,
+		Conn:       conn,
+		Bitfield:   bitfield.New(numPieces),
+		Choked:     true,
+		Extensions: remote.SupportsExtensions(),
+		numPieces:  numPieces,
 	}, nil
 }
 
-// Read reads and consumes a message from the connection
+// SetBitfield replaces c.Bitfield with the pieces announced by a Bitfield,
+// HaveAll or HaveNone message. The bitfield stays sized to the torrent:
+// bits past the last piece are ignored, and missing bytes are zero.
+//
+// We don't advertise the Fast extension, so HaveAll and HaveNone are only
+// accepted from peers that send them without negotiating it. Nothing else
+// of BEP 6 is implemented.
+func (c *Client) SetBitfield(msg *message.Message) error {
+	bf := bitfield.New(c.numPieces)
+	switch msg.ID {
+	case message.MsgBitfield:
+		peerBitfield := bitfield.Bitfield(msg.Payload)
+		for index := 0; index < c.numPieces; index++ {
+			if peerBitfield.HasPiece(index) {
+				bf.SetPiece(index)
+			}
+		}
+	case message.MsgHaveAll:
+		for index := 0; index < c.numPieces; index++ {
+			bf.SetPiece(index)
+		}
+	case message.MsgHaveNone:
+	default:
+		return fmt.Errorf("Expected bitfield but got ID %d", msg.ID)
+	}
+	c.Bitfield = bf
+	return nil
+}
+
+// Start makes the connection full-duplex: from now on, messages are
+// queued and written by a goroutine of their own, which also sends
+// keep-alives when the connection is idle. Send calls return at once,
+// except SendPiece, which waits while too many blocks are queued.
+func (c *Client) Start() {
+	c.out = newWriter(c.Conn)
+	go c.out.run()
+}
+
+// Run reads messages from the peer and passes them to handle, in the order
+// they arrive, until the connection fails, the peer stays silent for too
+// long or handle returns an error, which is returned
+func (c *Client) Run(handle Handler) error {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(readTimeout))
+		msg, err := c.Read()
+		if err != nil {
+			return err
+		}
+		err = handle(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the connection, dropping the messages still queued
+func (c *Client) Close() error {
+	if c.out != nil {
+		c.out.close()
+	}
+	return c.Conn.Close()
+}
+
+// Read reads and consumes a message from the connection. If the read
+// fails partway through a message, say because a deadline expired, the
+// bytes received so far are kept and the next call picks up from there.
 func (c *Client) Read() (*message.Message, error) {
-	msg, err := message.Read(c.Conn)
-	return msg, err
+	for {
+		if len(c.readBuf) >= 4 {
+			size := 4 + int(binary.BigEndian.Uint32(c.readBuf))
+			if len(c.readBuf) >= size {
+				msg, err := message.Read(bytes.NewReader(c.readBuf[:size]))
+				n := copy(c.readBuf, c.readBuf[size:])
+				c.readBuf = c.readBuf[:n]
+				return msg, err
+			}
+		}
+
+		if cap(c.readBuf)-len(c.readBuf) < readChunk {
+			buf := make([]byte, len(c.readBuf), len(c.readBuf)+readChunk)
+			copy(buf, c.readBuf)
+			c.readBuf = buf
+		}
+		n, err := c.Conn.Read(c.readBuf[len(c.readBuf):cap(c.readBuf)])
+		c.readBuf = c.readBuf[:len(c.readBuf)+n]
+		if err != nil {
+			return nil, err
+		}
+	}
 }
 
 // SendRequest sends a Request message to the peer
 func (c *Client) SendRequest(index, begin, length int) error {
 	req := message.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
-	return err
+	return c.send(req)
+}
+
+// SendBitfield sends a Bitfield message to the peer
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	return c.send(&message.Message{ID: message.MsgBitfield, Payload: bf})
+}
+
+// SendPiece sends a Piece message carrying a block of data to the peer
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	msg := message.FormatPiece(index, begin, block)
+	if c.out != nil {
+		return c.out.write(msg.Serialize(), true)
+	}
+	return c.send(msg)
 }
 
 // SendHave sends a Have message to the peer
 func (c *Client) SendHave(index int) error {
 	msg := message.FormatHave(index)
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(msg)
+}
+
+// SendExtended sends an extension protocol message (BEP 10)
+func (c *Client) SendExtended(extendedID uint8, payload []byte) error {
+	msg := message.FormatExtended(extendedID, payload)
+	return c.send(msg)
+}
+
+// SendCancel sends a Cancel message for a block we requested
+func (c *Client) SendCancel(index, begin, length int) error {
+	msg := message.FormatCancel(index, begin, length)
+	return c.send(msg)
 }
 
 // SendInterested sends an Interested message to the peer
 func (c *Client) SendInterested() error {
-	msg := message.Message{ID: message.MsgInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgInterested})
 }
 
 // SendNotInterested sends a NotInterested message to the peer
 func (c *Client) SendNotInterested() error {
-	msg := message.Message{ID: message.MsgNotInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgNotInterested})
+}
+
+// SendChoke sends a Choke message to the peer
+func (c *Client) SendChoke() error {
+	return c.send(&message.Message{ID: message.MsgChoke})
 }
 
 // SendUnchoke sends an Unchoke message to the peer
 func (c *Client) SendUnchoke() error {
-	msg := message.Message{ID: message.MsgUnchoke}
+	return c.send(&message.Message{ID: message.MsgUnchoke})
+}
+
+func (c *Client) send(msg *message.Message) error {
+	if c.out != nil {
+		return c.out.write(msg.Serialize(), false)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
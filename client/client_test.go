@@ -1,12 +1,15 @@
 package client
 
 import (
+	"errors"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/cedrickchee/min-torrent/bitfield"
 	"github.com/cedrickchee/min-torrent/handshake"
 	"github.com/cedrickchee/min-torrent/message"
+	"github.com/cedrickchee/min-torrent/peers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -73,39 +76,89 @@ func TestCompleteHandshake(t *testing.T) {
 	}
 }
 
-func TestRecvBitfield(t *testing.T) {
+func TestSetBitfield(t *testing.T) {
 	tests := map[string]struct {
-		msg    []byte
+		msg    *message.Message
 		output bitfield.Bitfield
 		fails  bool
 	}{
-		"successful bitfield": {
-			msg:    []byte{0x00, 0x00, 0x00, 0x06, 5, 1, 2, 3, 4, 5},
-			output: bitfield.Bitfield{1, 2, 3, 4, 5},
+		"bitfield": {
+			msg:    &message.Message{ID: message.MsgBitfield, Payload: []byte{0b10100000, 0b01000000}},
+			output: bitfield.Bitfield{0b10100000, 0b01000000},
+			fails:  false,
+		},
+		"spare bits and extra bytes": {
+			msg:    &message.Message{ID: message.MsgBitfield, Payload: []byte{0b10100000, 0b01111111, 0xff}},
+			output: bitfield.Bitfield{0b10100000, 0b01000000},
+			fails:  false,
+		},
+		"short bitfield": {
+			msg:    &message.Message{ID: message.MsgBitfield, Payload: []byte{0b10100000}},
+			output: bitfield.Bitfield{0b10100000, 0b00000000},
+			fails:  false,
+		},
+		"have all": {
+			msg:    &message.Message{ID: message.MsgHaveAll},
+			output: bitfield.Bitfield{0b11111111, 0b11000000},
+			fails:  false,
+		},
+		"have none": {
+			msg:    &message.Message{ID: message.MsgHaveNone},
+			output: bitfield.Bitfield{0b00000000, 0b00000000},
 			fails:  false,
 		},
 		"message is not a bitfield": {
-			msg:    []byte{0x00, 0x00, 0x00, 0x06, 99, 1, 2, 3, 4, 5},
-			output: nil,
+			msg:    &message.Message{ID: message.MsgHave, Payload: []byte{0, 0, 0, 1}},
+			output: bitfield.Bitfield{0b00000001, 0b00000000},
 			fails:  true,
 		},
 	}
 
-	for _, test := range tests {
-		clientConn, serverConn := createClientAndServer(t)
-		serverConn.Write(test.msg)
-
-		bf, err := recvBitfield(clientConn)
-
+	for name, test := range tests {
+		client := Client{Bitfield: bitfield.Bitfield{0b00000001, 0b00000000}, numPieces: 10}
+		err := client.SetBitfield(test.msg)
 		if test.fails {
-			assert.NotNil(t, err)
+			assert.NotNil(t, err, name)
 		} else {
-			assert.Nil(t, err)
-			assert.Equal(t, bf, test.output)
+			assert.Nil(t, err, name)
 		}
+		assert.Equal(t, test.output, client.Bitfield, name)
 	}
 }
 
+func TestNewIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available")
+	}
+	defer ln.Close()
+
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := handshake.Read(conn)
+		if err != nil {
+			return
+		}
+		assert.True(t, req.SupportsExtensions())
+		conn.Write(handshake.New(infoHash, peerID).Serialize())
+		conn.Read(make([]byte, 1)) // hold the connection until the client closes it
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	peer := peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	c, err := New(peer, peerID, infoHash, 12)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.Equal(t, bitfield.Bitfield{0x00, 0x00}, c.Bitfield) // no bitfield was sent
+	assert.False(t, c.Extensions)
+}
+
 func TestRead(t *testing.T) {
 	clientConn, serverConn := createClientAndServer(t)
 	client := Client{Conn: clientConn}
@@ -144,6 +197,36 @@ func TestSendRequest(t *testing.T) {
 	assert.Equal(t, expected, buf)
 }
 
+func TestSendExtended(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendExtended(0, []byte("de"))
+	assert.Nil(t, err)
+	expected := []byte{0x00, 0x00, 0x00, 0x04, 20, 0, 'd', 'e'}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestSendCancel(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendCancel(1, 2, 3)
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x0d,
+		8,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x03,
+	}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
 func TestSendInterested(t *testing.T) {
 	clientConn, serverConn := createClientAndServer(t)
 	client := Client{Conn: clientConn}
@@ -174,6 +257,21 @@ func TestSendNotInterested(t *testing.T) {
 	assert.Equal(t, expected, buf)
 }
 
+func TestSendChoke(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendChoke()
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x01,
+		0,
+	}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
 func TestSendUnchoke(t *testing.T) {
 	clientConn, serverConn := createClientAndServer(t)
 	client := Client{Conn: clientConn}
@@ -204,3 +302,126 @@ func TestSendHave(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, buf)
 }
+
+func TestAccept(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	// The remote peer already sent its handshake
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, err := handshake.Read(clientConn)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, infoHash, res.InfoHash)
+		assert.True(t, res.SupportsExtensions())
+		msg, err := message.Read(clientConn)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, &message.Message{ID: message.MsgBitfield, Payload: []byte{0b10100000}}, msg)
+	}()
+
+	remote := handshake.New(infoHash, [20]byte{5})
+	remote.EnableExtensions()
+	c, err := Accept(serverConn, remote, peerID, infoHash, bitfield.Bitfield{0b10100000}, 3)
+	require.Nil(t, err)
+	assert.True(t, c.Extensions)
+	assert.Equal(t, bitfield.Bitfield{0b00000000}, c.Bitfield)
+	assert.True(t, c.Choked)
+	<-done
+}
+
+func TestSendBitfield(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendBitfield(bitfield.Bitfield{0b10100000, 0b00000001})
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x03,
+		5,
+		0b10100000, 0b00000001,
+	}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestSendPiece(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendPiece(4, 567, []byte{0xaa, 0xbb})
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x0b,
+		7,
+		0x00, 0x00, 0x00, 0x04,
+		0x00, 0x00, 0x02, 0x37,
+		0xaa, 0xbb,
+	}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestReadResumesAfterTimeout(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+
+	// The message arrives in two parts, with the deadline expiring in between
+	_, err := serverConn.Write([]byte{0x00, 0x00, 0x00, 0x05, 4, 0x00})
+	require.Nil(t, err)
+	clientConn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	msg, err := client.Read()
+	assert.Nil(t, msg)
+	netErr, ok := err.(net.Error)
+	require.True(t, ok)
+	assert.True(t, netErr.Timeout())
+
+	clientConn.SetReadDeadline(time.Time{})
+	_, err = serverConn.Write([]byte{0x00, 0x05, 0x3c, 0x00, 0x00, 0x00, 0x00})
+	require.Nil(t, err)
+	msg, err = client.Read()
+	require.Nil(t, err)
+	assert.Equal(t, &message.Message{ID: message.MsgHave, Payload: []byte{0x00, 0x00, 0x05, 0x3c}}, msg)
+
+	// The keep-alive that followed in the same write is still there
+	msg, err = client.Read()
+	assert.Nil(t, err)
+	assert.Nil(t, msg)
+}
+
+func TestRun(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	defer client.Close()
+
+	// A Have, a keep-alive and an Unchoke
+	_, err := serverConn.Write([]byte{
+		0x00, 0x00, 0x00, 0x05, 4, 0x00, 0x00, 0x00, 0x07,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x01, 1,
+	})
+	require.Nil(t, err)
+
+	stop := errors.New("stop")
+	var got []*message.Message
+	err = client.Run(func(msg *message.Message) error {
+		got = append(got, msg)
+		if msg != nil && msg.ID == message.MsgUnchoke {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, []*message.Message{
+		{ID: message.MsgHave, Payload: []byte{0x00, 0x00, 0x00, 0x07}},
+		nil,
+		{ID: message.MsgUnchoke, Payload: []byte{}},
+	}, got)
+}
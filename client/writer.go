@@ -0,0 +1,118 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// keepAliveInterval is how long the connection may stay idle before a
+// keep-alive is sent. Peers drop connections silent for two minutes or so.
+const keepAliveInterval = 90 * time.Second
+
+// maxQueued bounds the bytes of blocks waiting to be written. Other
+// messages are small and never wait.
+const maxQueued = 256 * 1024
+
+// writeBufferSize is how many bytes are written to the connection at once
+const writeBufferSize = 64 * 1024
+
+var errWriterClosed = errors.New("Connection is closed")
+
+// writer queues messages and writes them to a connection from its own
+// goroutine, so that senders don't wait on each other or on the peer.
+// Messages queued together are written with as few calls as possible.
+type writer struct {
+	conn      net.Conn
+	keepAlive *time.Timer
+
+	mu     sync.Mutex
+	cond   *sync.Cond // signalled when the queue changes
+	queue  [][]byte
+	queued int   // bytes in queue
+	err    error // set once the connection failed or was closed
+}
+
+func newWriter(conn net.Conn) *writer {
+	w := &writer{conn: conn}
+	w.cond = sync.NewCond(&w.mu)
+	w.keepAlive = time.AfterFunc(keepAliveInterval, func() {
+		w.write(make([]byte, 4), false)
+	})
+	return w
+}
+
+// write queues a serialized message. If wait is set, it first waits until
+// the bytes already queued are under maxQueued. Returns an error if the
+// connection failed.
+func (w *writer) write(buf []byte, wait bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for wait && w.queued >= maxQueued && w.err == nil {
+		w.cond.Wait()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	w.queue = append(w.queue, buf)
+	w.queued += len(buf)
+	w.cond.Broadcast()
+	return nil
+}
+
+// run writes queued messages until the connection fails or the writer is
+// closed
+func (w *writer) run() {
+	bw := bufio.NewWriterSize(w.conn, writeBufferSize)
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && w.err == nil {
+			w.cond.Wait()
+		}
+		if w.err != nil {
+			w.mu.Unlock()
+			return
+		}
+		queue := w.queue
+		w.queue = nil
+		w.queued = 0
+		w.cond.Broadcast() // there is room again
+		w.mu.Unlock()
+
+		var err error
+		for _, buf := range queue {
+			_, err = bw.Write(buf)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			w.fail(err)
+			return
+		}
+		w.keepAlive.Reset(keepAliveInterval)
+	}
+}
+
+// fail discards the queue and makes every later write return err
+func (w *writer) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.queue = nil
+	w.queued = 0
+	w.keepAlive.Stop()
+	w.cond.Broadcast()
+}
+
+// close stops the writer. Messages still queued are dropped.
+func (w *writer) close() {
+	w.fail(errWriterClosed)
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"io"
+	"testing"
+
+	"github.com/cedrickchee/min-torrent/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStart(t *testing.T) {
+	tests := map[string]struct {
+		send     func(c *Client) error
+		expected []byte
+	}{
+		"messages in order": {
+			send: func(c *Client) error {
+				err := c.SendInterested()
+				if err != nil {
+					return err
+				}
+				return c.SendHave(2)
+			},
+			expected: []byte{
+				0x00, 0x00, 0x00, 0x01, 2,
+				0x00, 0x00, 0x00, 0x05, 4, 0x00, 0x00, 0x00, 0x02,
+			},
+		},
+		"block": {
+			send: func(c *Client) error {
+				return c.SendPiece(1, 2, []byte{0xaa})
+			},
+			expected: []byte{
+				0x00, 0x00, 0x00, 0x0a, 7,
+				0x00, 0x00, 0x00, 0x01,
+				0x00, 0x00, 0x00, 0x02,
+				0xaa,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		clientConn, serverConn := createClientAndServer(t)
+		client := Client{Conn: clientConn}
+		client.Start()
+
+		err := test.send(&client)
+		require.Nil(t, err, name)
+		buf := make([]byte, len(test.expected))
+		_, err = io.ReadFull(serverConn, buf)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.expected, buf, name)
+
+		client.Close()
+		serverConn.Close()
+	}
+}
+
+func TestSendAfterClose(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	defer serverConn.Close()
+	client := Client{Conn: clientConn}
+	client.Start()
+	client.Close()
+
+	err := client.SendInterested()
+	assert.Equal(t, errWriterClosed, err)
+	err = client.send(&message.Message{ID: message.MsgUnchoke})
+	assert.NotNil(t, err)
+}
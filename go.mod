@@ -2,7 +2,4 @@ module github.com/cedrickchee/min-torrent
 
 go 1.13
 
-require (
-	github.com/jackpal/bencode-go v0.0.0-20180813173944-227668e840fa
-	github.com/stretchr/testify v1.4.0
-)
+require github.com/stretchr/testify v1.4.0
@@ -8,6 +8,7 @@ import (
 // A Handshake is a special message that a peer uses to identify itself
 type Handshake struct {
 	Pstr     string   // the protocol identifier
+	Reserved [8]byte  // bits advertising support for protocol extensions
 	InfoHash [20]byte // which file we want
 	PeerID   [20]byte // made up ID to identify ourselves
 }
@@ -20,6 +21,17 @@ func New(infoHash, peerID [20]byte) *Handshake {
 	}
 }
 
+// EnableExtensions sets the reserved bit advertising the extension
+// protocol (BEP 10)
+func (h *Handshake) EnableExtensions() {
+	h.Reserved[5] |= 0x10
+}
+
+// SupportsExtensions tells if the extension protocol bit (BEP 10) is set
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&0x10 != 0
+}
+
 // Serialize serializes the handshake to a buffer
 //
 // BitTorrent handshake is made up of five parts:
@@ -40,7 +52,7 @@ func (h *Handshake) Serialize() []byte {
 
 	idxCurr := 1
 	idxCurr += copy(buf[idxCurr:], h.Pstr)
-	idxCurr += copy(buf[idxCurr:], make([]byte, 8)) // Leave 8 reserved bytes
+	idxCurr += copy(buf[idxCurr:], h.Reserved[:])
 	idxCurr += copy(buf[idxCurr:], h.InfoHash[:])
 	idxCurr += copy(buf[idxCurr:], h.PeerID[:])
 
@@ -68,13 +80,16 @@ func Read(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrLen:pstrLen+8])
 	copy(infoHash[:], handshakeBuf[pstrLen+8:pstrLen+8+20])
 	copy(peerID[:], handshakeBuf[pstrLen+8+20:])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuf[0:pstrLen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
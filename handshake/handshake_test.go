@@ -63,6 +63,16 @@ func TestRead(t *testing.T) {
 			},
 			fails: false,
 		},
+		"parse reserved bits": {
+			input: []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0x10, 0, 0x05, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			output: &Handshake{
+				Pstr:     "BitTorrent protocol",
+				Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x05},
+				InfoHash: [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116},
+				PeerID:   [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			},
+			fails: false,
+		},
 		"empty": {
 			input:  []byte{},
 			output: nil,
@@ -91,3 +101,11 @@ func TestRead(t *testing.T) {
 		assert.Equal(t, test.output, m)
 	}
 }
+
+func TestExtensions(t *testing.T) {
+	h := New([20]byte{}, [20]byte{})
+	assert.False(t, h.SupportsExtensions())
+	h.EnableExtensions()
+	assert.True(t, h.SupportsExtensions())
+	assert.Equal(t, byte(0x10), h.Serialize()[1+19+5])
+}
@@ -0,0 +1,110 @@
+package listener
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/handshake"
+)
+
+// handshakeTimeout bounds how long a new connection may take to identify
+// the torrent it wants
+const handshakeTimeout = 10 * time.Second
+
+// Handler takes over incoming connections for one torrent
+type Handler interface {
+	// HandlePeer is given a connection whose handshake has already been
+	// read and matched to the torrent. It is responsible for replying with
+	// its own handshake and for closing the connection.
+	HandlePeer(conn net.Conn, remote *handshake.Handshake)
+}
+
+// Listener accepts incoming peer connections and routes them to torrents
+// by the info hash in their handshake
+type Listener struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	handlers map[[20]byte]Handler
+	closed   bool
+}
+
+// Listen starts listening for peers on a TCP port, over both IPv4 and IPv6
+func Listen(port uint16) (*Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{ln: ln, handlers: make(map[[20]byte]Handler)}, nil
+}
+
+// Addr returns the address the listener accepts connections on
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Add routes connections for a torrent to a handler
+func (l *Listener) Add(infoHash [20]byte, h Handler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handlers[infoHash] = h
+}
+
+// Remove stops routing connections for a torrent
+func (l *Listener) Remove(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.handlers, infoHash)
+}
+
+// Serve accepts connections until the listener is closed
+func (l *Listener) Serve() error {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go l.handle(conn)
+	}
+}
+
+// Close stops accepting connections. Connections already handed to a
+// torrent are not affected.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	return l.ln.Close()
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	hs, err := handshake.Read(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{}) // disable the deadline
+
+	l.mu.Lock()
+	h, ok := l.handlers[hs.InfoHash]
+	l.mu.Unlock()
+	if !ok {
+		log.Printf("Rejected %s asking for unknown infohash %x\n", conn.RemoteAddr(), hs.InfoHash)
+		conn.Close()
+		return
+	}
+	h.HandlePeer(conn, hs)
+}
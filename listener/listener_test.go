@@ -0,0 +1,98 @@
+package listener
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/handshake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type handlerFunc func(conn net.Conn, remote *handshake.Handshake)
+
+func (f handlerFunc) HandlePeer(conn net.Conn, remote *handshake.Handshake) {
+	f(conn, remote)
+}
+
+func TestListenerRoutesByInfoHash(t *testing.T) {
+	l, err := Listen(0)
+	require.Nil(t, err)
+	go l.Serve()
+	defer l.Close()
+
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	handled := make(chan *handshake.Handshake, 1)
+	l.Add(infoHash, handlerFunc(func(conn net.Conn, remote *handshake.Handshake) {
+		defer conn.Close()
+		conn.Write(handshake.New(infoHash, [20]byte{9}).Serialize())
+		handled <- remote
+	}))
+
+	tests := map[string]struct {
+		infoHash [20]byte
+		routed   bool
+	}{
+		"known infohash": {
+			infoHash: infoHash,
+			routed:   true,
+		},
+		"unknown infohash": {
+			infoHash: [20]byte{0xde, 0xad},
+			routed:   false,
+		},
+	}
+
+	for name, test := range tests {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.Nil(t, err, name)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write(handshake.New(test.infoHash, peerID).Serialize())
+		require.Nil(t, err, name)
+
+		res, err := handshake.Read(conn)
+		if test.routed {
+			require.Nil(t, err, name)
+			assert.Equal(t, infoHash, res.InfoHash, name)
+			remote := <-handled
+			assert.Equal(t, peerID, remote.PeerID, name)
+		} else {
+			assert.Equal(t, io.EOF, err, name)
+		}
+		conn.Close()
+	}
+}
+
+func TestListenerRemove(t *testing.T) {
+	l, err := Listen(0)
+	require.Nil(t, err)
+	go l.Serve()
+	defer l.Close()
+
+	infoHash := [20]byte{1}
+	l.Add(infoHash, handlerFunc(func(conn net.Conn, remote *handshake.Handshake) {
+		t.Error("Removed handler was called")
+		conn.Close()
+	}))
+	l.Remove(infoHash)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(handshake.New(infoHash, [20]byte{2}).Serialize())
+	_, err = handshake.Read(conn)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServeReturnsAfterClose(t *testing.T) {
+	l, err := Listen(0)
+	require.Nil(t, err)
+	errs := make(chan error)
+	go func() { errs <- l.Serve() }()
+	l.Close()
+	assert.Nil(t, <-errs)
+}
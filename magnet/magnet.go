@@ -0,0 +1,126 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Magnet holds the parts of a magnet URI used to find and download a torrent
+type Magnet struct {
+	InfoHash    [20]byte
+	DisplayName string   // dn: suggested name, used until the metadata arrives
+	Trackers    []string // tr: tracker announce URLs
+	WebSeeds    []string // ws: web seed URLs
+	Peers       []string // x.pe: peer addresses as host:port
+}
+
+const btihPrefix = "urn:btih:"
+
+// Parse parses a magnet URI of the form
+// magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker>...
+//
+// The info hash may be hex (40 characters) or base32 (32 characters)
+// encoded. Parameters may also carry a numeric suffix, as in tr.1 and tr.2,
+// to list several values.
+func Parse(uri string) (Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Magnet{}, err
+	}
+	if u.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("Expected magnet URI, got scheme %q", u.Scheme)
+	}
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return Magnet{}, err
+	}
+
+	// Walk the keys in order so that tr.1, tr.2, ..., tr.10 keep their order
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		iName, iNum := splitKey(keys[i])
+		jName, jNum := splitKey(keys[j])
+		if iName != jName {
+			return iName < jName
+		}
+		if iNum != jNum {
+			return iNum < jNum
+		}
+		return keys[i] < keys[j]
+	})
+
+	m := Magnet{}
+	foundHash := false
+	for _, rawKey := range keys {
+		values := params[rawKey]
+		key, _ := splitKey(rawKey)
+		for _, value := range values {
+			switch key {
+			case "xt":
+				if !strings.HasPrefix(value, btihPrefix) {
+					continue // not a BitTorrent info hash
+				}
+				m.InfoHash, err = parseInfoHash(value[len(btihPrefix):])
+				if err != nil {
+					return Magnet{}, err
+				}
+				foundHash = true
+			case "dn":
+				m.DisplayName = value
+			case "tr":
+				m.Trackers = append(m.Trackers, value)
+			case "ws":
+				m.WebSeeds = append(m.WebSeeds, value)
+			case "x.pe":
+				m.Peers = append(m.Peers, value)
+			}
+		}
+	}
+	if !foundHash {
+		return Magnet{}, errors.New("Magnet URI has no urn:btih info hash")
+	}
+	return m, nil
+}
+
+// splitKey strips the suffix from keys like "tr.1", returning the
+// parameter name and the suffix as a number. The number is -1 if the key
+// has no numeric suffix.
+func splitKey(key string) (string, int) {
+	i := strings.IndexByte(key, '.')
+	if i < 0 || key == "x.pe" {
+		return key, -1
+	}
+	n, err := strconv.Atoi(key[i+1:])
+	if err != nil {
+		n = -1
+	}
+	return key[:i], n
+}
+
+func parseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+	var buf []byte
+	var err error
+	switch len(s) {
+	case 40:
+		buf, err = hex.DecodeString(s)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return infoHash, fmt.Errorf("Info hash %q has invalid length %d", s, len(s))
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("Malformed info hash %q: %v", s, err)
+	}
+	copy(infoHash[:], buf)
+	return infoHash, nil
+}
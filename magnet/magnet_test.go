@@ -0,0 +1,85 @@
+package magnet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	infoHash := [20]byte{0xfc, 0x9a, 0xf3, 0x36, 0x7b, 0x72, 0xc6, 0x3c, 0x9f, 0x7d, 0xa9, 0x33, 0x4b, 0xa0, 0x6c, 0xb1, 0x00, 0xaf, 0xc3, 0xe1}
+	tests := map[string]struct {
+		input  string
+		output Magnet
+		fails  bool
+	}{
+		"hex info hash with all fields": {
+			input: "magnet:?xt=urn:btih:fc9af3367b72c63c9f7da9334ba06cb100afc3e1" +
+				"&dn=in+our+time" +
+				"&tr=http%3A%2F%2Fbt1.archive.org%3A6969%2Fannounce" +
+				"&tr=udp%3A%2F%2Ftracker.example.org%3A1337" +
+				"&ws=https%3A%2F%2Farchive.org%2Fdownload%2F" +
+				"&x.pe=10.0.0.1%3A6881",
+			output: Magnet{
+				InfoHash:    infoHash,
+				DisplayName: "in our time",
+				Trackers:    []string{"http://bt1.archive.org:6969/announce", "udp://tracker.example.org:1337"},
+				WebSeeds:    []string{"https://archive.org/download/"},
+				Peers:       []string{"10.0.0.1:6881"},
+			},
+			fails: false,
+		},
+		"base32 info hash": {
+			input:  "magnet:?xt=urn:btih:7SNPGNT3OLDDZH35VEZUXIDMWEAK7Q7B",
+			output: Magnet{InfoHash: infoHash},
+			fails:  false,
+		},
+		"numbered parameters": {
+			input: "magnet:?xt=urn:btih:fc9af3367b72c63c9f7da9334ba06cb100afc3e1&tr.2=http%3A%2F%2Fb&tr.1=http%3A%2F%2Fa",
+			output: Magnet{
+				InfoHash: infoHash,
+				Trackers: []string{"http://a", "http://b"},
+			},
+			fails: false,
+		},
+		"ten or more numbered parameters": {
+			input: "magnet:?xt=urn:btih:fc9af3367b72c63c9f7da9334ba06cb100afc3e1" +
+				"&tr.10=http%3A%2F%2Fj&tr.2=http%3A%2F%2Fb&tr.11=http%3A%2F%2Fk&tr.1=http%3A%2F%2Fa" +
+				"&tr.3=http%3A%2F%2Fc&tr.4=http%3A%2F%2Fd&tr.5=http%3A%2F%2Fe&tr.6=http%3A%2F%2Ff" +
+				"&tr.7=http%3A%2F%2Fg&tr.8=http%3A%2F%2Fh&tr.9=http%3A%2F%2Fi&tr=http%3A%2F%2Fz",
+			output: Magnet{
+				InfoHash: infoHash,
+				Trackers: []string{
+					"http://z", "http://a", "http://b", "http://c", "http://d", "http://e",
+					"http://f", "http://g", "http://h", "http://i", "http://j", "http://k",
+				},
+			},
+			fails: false,
+		},
+		"missing info hash": {
+			input:  "magnet:?dn=foo&xt=urn:sha1:YNCKHTQCWBTRNJIV4WNAE52SJUQCZO5C",
+			output: Magnet{},
+			fails:  true,
+		},
+		"malformed info hash": {
+			input:  "magnet:?xt=urn:btih:zz9af3367b72c63c9f7da9334ba06cb100afc3e1",
+			output: Magnet{},
+			fails:  true,
+		},
+		"not a magnet URI": {
+			input:  "http://example.org/?xt=urn:btih:fc9af3367b72c63c9f7da9334ba06cb100afc3e1",
+			output: Magnet{},
+			fails:  true,
+		},
+	}
+
+	for _, test := range tests {
+		m, err := Parse(test.input)
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.output, m)
+	}
+}
@@ -1,22 +1,147 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
 
 	"github.com/cedrickchee/min-torrent/torrentfile"
 )
 
+const usage = `Usage:
+  min-torrent <torrent file or magnet link> <output path>
+  min-torrent scrape <torrent file>
+  min-torrent seed <torrent file> <data path>
+  min-torrent verify [-workers n] [-repair] <torrent file> <data path>`
+
 func main() {
-	inPath := os.Args[1]
-	outPath := os.Args[2]
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+
+	switch os.Args[1] {
+	case "scrape":
+		checkArgs(3)
+		scrape(os.Args[2])
+	case "seed":
+		checkArgs(4)
+		seed(os.Args[2], os.Args[3])
+	case "verify":
+		verify(os.Args[2:])
+	default:
+		checkArgs(3)
+		download(os.Args[1], os.Args[2])
+	}
+}
+
+func checkArgs(n int) {
+	if len(os.Args) != n {
+		log.Fatal(usage)
+	}
+}
+
+func download(inPath, outPath string) {
+	var t torrentfile.TorrentFile
+	var err error
+	if strings.HasPrefix(inPath, "magnet:") {
+		t, err = torrentfile.OpenMagnet(inPath)
+	} else {
+		t, err = torrentfile.Open(inPath)
+	}
+	checkError(err)
+	err = t.DownloadToFile(outPath, stopOnSignal())
+	checkError(err)
+}
+
+// scrape prints the swarm statistics reported by each tracker
+func scrape(inPath string) {
+	t, err := torrentfile.Open(inPath)
+	checkError(err)
+	for _, res := range t.Scrape() {
+		if res.Err != nil {
+			fmt.Printf("%s: %v\n", res.Tracker, res.Err)
+			continue
+		}
+		fmt.Printf("%s: %d seeders, %d leechers, %d completed\n",
+			res.Tracker, res.Seeders, res.Leechers, res.Completed)
+	}
+}
 
+// seed shares local data until interrupted
+func seed(inPath, dataPath string) {
 	t, err := torrentfile.Open(inPath)
 	checkError(err)
-	err = t.DownloadToFile(outPath)
+	err = t.Seed(dataPath, stopOnSignal())
 	checkError(err)
 }
 
+// verify hash-checks local data and reports the damaged pieces and files,
+// optionally downloading them again. Exits with status 1 if damage remains.
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	workers := flags.Int("workers", runtime.NumCPU(), "number of pieces to hash at once")
+	repair := flags.Bool("repair", false, "download the missing and corrupt pieces again")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		log.Fatal(usage)
+	}
+	inPath, dataPath := flags.Arg(0), flags.Arg(1)
+
+	t, err := torrentfile.Open(inPath)
+	checkError(err)
+	report, err := t.Verify(dataPath, *workers)
+	checkError(err)
+
+	for _, f := range report.Files {
+		path := f.Path
+		if path == "" {
+			path = dataPath
+		}
+		switch {
+		case f.Missing:
+			fmt.Printf("%s: missing\n", path)
+		case f.Size != f.Length:
+			fmt.Printf("%s: has length %d, expected %d\n", path, f.Size, f.Length)
+		default:
+			fmt.Printf("%s: %d bad pieces\n", path, len(f.BadPieces))
+		}
+	}
+	if len(report.Missing) > 0 {
+		fmt.Printf("Missing pieces: %v\n", report.Missing)
+	}
+	if len(report.Corrupt) > 0 {
+		fmt.Printf("Corrupt pieces: %v\n", report.Corrupt)
+	}
+	intact := report.Pieces - len(report.Missing) - len(report.Corrupt)
+	fmt.Printf("%d of %d pieces intact\n", intact, report.Pieces)
+
+	if report.OK() {
+		return
+	}
+	if !*repair {
+		os.Exit(1)
+	}
+	err = t.Repair(dataPath, report, stopOnSignal())
+	checkError(err)
+}
+
+// stopOnSignal returns a channel that is closed when we are interrupted
+func stopOnSignal() <-chan struct{} {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	return stop
+}
+
 func checkError(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -28,6 +28,14 @@ const (
 	MsgPiece messageID = 7
 	// MsgCancel cancels a request
 	MsgCancel messageID = 8
+	// MsgHaveAll tells the receiver that the sender has every piece, in
+	// place of a bitfield (Fast extension, BEP 6)
+	MsgHaveAll messageID = 14
+	// MsgHaveNone tells the receiver that the sender has no pieces, in
+	// place of a bitfield (Fast extension, BEP 6)
+	MsgHaveNone messageID = 15
+	// MsgExtended carries an extension protocol message (BEP 10)
+	MsgExtended messageID = 20
 )
 
 // Message stores ID and payload of a message
@@ -103,6 +111,12 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -128,6 +142,13 @@ func FormatRequest(index, begin, length int) *Message {
 	}
 }
 
+// FormatCancel creates a CANCEL message for a block we requested
+func FormatCancel(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgCancel
+	return msg
+}
+
 // FormatHave creates a HAVE message
 func FormatHave(index int) *Message {
 	payload := make([]byte, 4)
@@ -135,6 +156,32 @@ func FormatHave(index int) *Message {
 	return &Message{ID: MsgHave, Payload: payload}
 }
 
+// FormatPiece creates a PIECE message carrying a block of data
+func FormatPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+// ParseRequest parses a REQUEST or CANCEL message, which share the same
+// layout
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgRequest && msg.ID != MsgCancel {
+		err = fmt.Errorf("Expected REQUEST (ID %d) or CANCEL (ID %d), got ID %d", MsgRequest, MsgCancel, msg.ID)
+		return 0, 0, 0, err
+	}
+	if len(msg.Payload) != 12 {
+		err = fmt.Errorf("Expected payload length 12, got length %d", len(msg.Payload))
+		return 0, 0, 0, err
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
 // ParsePiece parses a PIECE message and copies its payload into a buffer
 func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	if msg.ID != MsgPiece {
@@ -159,6 +206,21 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// ParseBlock parses a PIECE message into the block of data it carries
+func ParseBlock(msg *Message) (index, begin int, block []byte, err error) {
+	if msg.ID != MsgPiece {
+		err = fmt.Errorf("Expected PIECE (ID %d), got ID %d", MsgPiece, msg.ID)
+		return 0, 0, nil, err
+	}
+	if len(msg.Payload) < 8 {
+		err = fmt.Errorf("Payload too short. %d < 8", len(msg.Payload))
+		return 0, 0, nil, err
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
 // ParseHave parses a HAVE message
 func ParseHave(msg *Message) (int, error) {
 	if msg.ID != MsgHave {
@@ -170,3 +232,24 @@ func ParseHave(msg *Message) (int, error) {
 	index := int(binary.BigEndian.Uint32(msg.Payload))
 	return index, nil
 }
+
+// FormatExtended creates an EXTENDED message. ID 0 is the extension
+// handshake; other IDs are the ones negotiated during that handshake.
+func FormatExtended(extendedID uint8, payload []byte) *Message {
+	buf := make([]byte, len(payload)+1)
+	buf[0] = extendedID
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// ParseExtended parses an EXTENDED message into its extended message ID
+// and payload
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("Expected EXTENDED (ID %d), got ID %d", MsgExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("Payload too short. %d < 1", len(msg.Payload))
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
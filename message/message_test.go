@@ -83,6 +83,9 @@ func TestString(t *testing.T) {
 		{&Message{MsgRequest, []byte{1, 2, 3}}, "Request [3]"},
 		{&Message{MsgPiece, []byte{1, 2, 3}}, "Piece [3]"},
 		{&Message{MsgCancel, []byte{1, 2, 3}}, "Cancel [3]"},
+		{&Message{MsgHaveAll, []byte{}}, "HaveAll [0]"},
+		{&Message{MsgHaveNone, []byte{}}, "HaveNone [0]"},
+		{&Message{MsgExtended, []byte{1, 2, 3}}, "Extended [3]"},
 		{&Message{99, []byte{1, 2, 3}}, "Unknown#99 [3]"},
 	}
 
@@ -105,6 +108,19 @@ func TestFormatRequest(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestFormatCancel(t *testing.T) {
+	msg := FormatCancel(4, 567, 4321)
+	expected := &Message{
+		ID: MsgCancel,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0x00, 0x00, 0x10, 0xe1, // Length
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
 func TestFormatHave(t *testing.T) {
 	msg := FormatHave(4)
 	expected := &Message{
@@ -114,6 +130,69 @@ func TestFormatHave(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestFormatPiece(t *testing.T) {
+	msg := FormatPiece(4, 567, []byte{0xaa, 0xbb})
+	expected := &Message{
+		ID: MsgPiece,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0xaa, 0xbb, // Block
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestParseRequest(t *testing.T) {
+	payload := []byte{
+		0x00, 0x00, 0x00, 0x04, // Index
+		0x00, 0x00, 0x02, 0x37, // Begin
+		0x00, 0x00, 0x10, 0xe1, // Length
+	}
+	tests := map[string]struct {
+		input  *Message
+		index  int
+		begin  int
+		length int
+		fails  bool
+	}{
+		"parse request": {
+			input:  &Message{ID: MsgRequest, Payload: payload},
+			index:  4,
+			begin:  567,
+			length: 4321,
+			fails:  false,
+		},
+		"parse cancel": {
+			input:  &Message{ID: MsgCancel, Payload: payload},
+			index:  4,
+			begin:  567,
+			length: 4321,
+			fails:  false,
+		},
+		"wrong message type": {
+			input: &Message{ID: MsgHave, Payload: payload},
+			fails: true,
+		},
+		"payload too short": {
+			input: &Message{ID: MsgRequest, Payload: payload[:11]},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		index, begin, length, err := ParseRequest(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.index, index, name)
+		assert.Equal(t, test.begin, begin, name)
+		assert.Equal(t, test.length, length, name)
+	}
+}
+
 func TestParsePiece(t *testing.T) {
 	tests := map[string]struct {
 		inputIndex int
@@ -223,6 +302,61 @@ func TestParsePiece(t *testing.T) {
 	}
 }
 
+func TestParseBlock(t *testing.T) {
+	tests := map[string]struct {
+		input *Message
+		index int
+		begin int
+		block []byte
+		fails bool
+	}{
+		"parse block": {
+			input: &Message{
+				ID: MsgPiece,
+				Payload: []byte{
+					0x00, 0x00, 0x00, 0x04, // Index
+					0x00, 0x00, 0x02, 0x37, // Begin
+					0xaa, 0xbb, // Block
+				},
+			},
+			index: 4,
+			begin: 567,
+			block: []byte{0xaa, 0xbb},
+			fails: false,
+		},
+		"empty block": {
+			input: &Message{
+				ID:      MsgPiece,
+				Payload: []byte{0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x02, 0x37},
+			},
+			index: 4,
+			begin: 567,
+			block: []byte{},
+			fails: false,
+		},
+		"wrong message type": {
+			input: &Message{ID: MsgHave, Payload: []byte{0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x02, 0x37}},
+			fails: true,
+		},
+		"payload too short": {
+			input: &Message{ID: MsgPiece, Payload: []byte{0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x02}},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		index, begin, block, err := ParseBlock(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.index, index, name)
+		assert.Equal(t, test.begin, begin, name)
+		assert.Equal(t, test.block, block, name)
+	}
+}
+
 func TestParseHave(t *testing.T) {
 	tests := map[string]struct {
 		input  *Message
@@ -261,3 +395,51 @@ func TestParseHave(t *testing.T) {
 		assert.Equal(t, test.output, index)
 	}
 }
+
+func TestFormatExtended(t *testing.T) {
+	msg := FormatExtended(3, []byte("de"))
+	expected := &Message{
+		ID:      MsgExtended,
+		Payload: []byte{3, 'd', 'e'},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestParseExtended(t *testing.T) {
+	tests := map[string]struct {
+		input      *Message
+		outputID   uint8
+		outputData []byte
+		fails      bool
+	}{
+		"parse valid message": {
+			input:      &Message{ID: MsgExtended, Payload: []byte{0, 'd', 'e'}},
+			outputID:   0,
+			outputData: []byte{'d', 'e'},
+			fails:      false,
+		},
+		"wrong message type": {
+			input:      &Message{ID: MsgHave, Payload: []byte{0, 'd', 'e'}},
+			outputID:   0,
+			outputData: nil,
+			fails:      true,
+		},
+		"payload too short": {
+			input:      &Message{ID: MsgExtended, Payload: []byte{}},
+			outputID:   0,
+			outputData: nil,
+			fails:      true,
+		},
+	}
+
+	for _, test := range tests {
+		id, data, err := ParseExtended(test.input)
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.outputID, id)
+		assert.Equal(t, test.outputData, data)
+	}
+}
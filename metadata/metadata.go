@@ -0,0 +1,236 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/bencode"
+	"github.com/cedrickchee/min-torrent/handshake"
+	"github.com/cedrickchee/min-torrent/message"
+	"github.com/cedrickchee/min-torrent/peers"
+)
+
+// BlockSize is the size of a metadata piece (BEP 9)
+const BlockSize = 16384
+
+// MaxSize is the largest info dictionary we are willing to download
+const MaxSize = 16 * 1024 * 1024
+
+// utMetadataID is the extended message ID we ask peers to use when they
+// send us ut_metadata messages
+const utMetadataID = 1
+
+// ut_metadata message types
+const (
+	msgRequest = 0
+	msgData    = 1
+	msgReject  = 2
+)
+
+type extendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// Fetch downloads the info dictionary of a torrent from a swarm using the
+// metadata extension (BEP 9). Peers are tried concurrently, and the first
+// dictionary whose SHA-1 matches infoHash is returned.
+func Fetch(peerList []peers.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	if len(peerList) == 0 {
+		return nil, errors.New("No peers to fetch metadata from")
+	}
+
+	type result struct {
+		info []byte
+		err  error
+	}
+	results := make(chan result, len(peerList))
+	for _, peer := range peerList {
+		go func(peer peers.Peer) {
+			info, err := fetchFromPeer(peer, peerID, infoHash)
+			if err != nil {
+				log.Printf("Could not fetch metadata from %s: %v\n", peer, err)
+			}
+			results <- result{info, err}
+		}(peer)
+	}
+
+	var lastErr error
+	for range peerList {
+		res := <-results
+		if res.err == nil {
+			return res.info, nil
+		}
+		lastErr = res.err
+	}
+	return nil, fmt.Errorf("No peer could provide metadata: %v", lastErr)
+}
+
+func fetchFromPeer(peer peers.Peer, peerID, infoHash [20]byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The whole exchange is small, so one deadline covers it
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	req := handshake.New(infoHash, peerID)
+	req.EnableExtensions()
+	_, err = conn.Write(req.Serialize())
+	if err != nil {
+		return nil, err
+	}
+	res, err := handshake.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(res.InfoHash[:], infoHash[:]) {
+		return nil, fmt.Errorf("Expected infohash %x but got %x", infoHash, res.InfoHash)
+	}
+	if !res.SupportsExtensions() {
+		return nil, errors.New("Peer does not support the extension protocol")
+	}
+
+	payload, err := bencode.Marshal(extendedHandshake{
+		M: map[string]int{"ut_metadata": utMetadataID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(message.FormatExtended(0, payload).Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	return readMetadata(conn, infoHash)
+}
+
+// readMetadata waits for the peer's extension handshake, requests every
+// metadata piece, and assembles and verifies the info dictionary
+func readMetadata(conn net.Conn, infoHash [20]byte) ([]byte, error) {
+	var buf []byte
+	var have []bool
+	remaining := 0
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue // keep-alive, bitfield, have...
+		}
+		extendedID, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		switch extendedID {
+		case 0:
+			if buf != nil {
+				continue // already asked for the pieces
+			}
+			remoteID, size, err := parseExtendedHandshake(payload)
+			if err != nil {
+				return nil, err
+			}
+			buf = make([]byte, size)
+			numPieces := (size + BlockSize - 1) / BlockSize
+			have = make([]bool, numPieces)
+			remaining = numPieces
+			for i := 0; i < numPieces; i++ {
+				req, err := bencode.Marshal(metadataMessage{MsgType: msgRequest, Piece: i})
+				if err != nil {
+					return nil, err
+				}
+				_, err = conn.Write(message.FormatExtended(remoteID, req).Serialize())
+				if err != nil {
+					return nil, err
+				}
+			}
+		case utMetadataID:
+			if buf == nil {
+				return nil, errors.New("Received metadata before extension handshake")
+			}
+			piece, err := parseMetadataPiece(payload, buf)
+			if err != nil {
+				return nil, err
+			}
+			if piece < 0 || have[piece] {
+				continue
+			}
+			have[piece] = true
+			remaining--
+			if remaining == 0 {
+				hash := sha1.Sum(buf)
+				if !bytes.Equal(hash[:], infoHash[:]) {
+					return nil, errors.New("Metadata failed integrity check")
+				}
+				return buf, nil
+			}
+		}
+	}
+}
+
+// parseExtendedHandshake returns the peer's ut_metadata message ID and the
+// size of the info dictionary
+func parseExtendedHandshake(payload []byte) (uint8, int, error) {
+	hs := extendedHandshake{}
+	err := bencode.Unmarshal(payload, &hs)
+	if err != nil {
+		return 0, 0, err
+	}
+	remoteID, ok := hs.M["ut_metadata"]
+	if !ok || remoteID <= 0 || remoteID > 255 {
+		return 0, 0, errors.New("Peer does not support ut_metadata")
+	}
+	if hs.MetadataSize <= 0 || hs.MetadataSize > MaxSize {
+		return 0, 0, fmt.Errorf("Invalid metadata size %d", hs.MetadataSize)
+	}
+	return uint8(remoteID), hs.MetadataSize, nil
+}
+
+// parseMetadataPiece copies the data of a ut_metadata data message into
+// buf. Returns the index of the piece, or -1 for other message types.
+func parseMetadataPiece(payload []byte, buf []byte) (int, error) {
+	// The bencoded header is followed by the raw piece data
+	d := bencode.NewDecoder(bytes.NewReader(payload))
+	msg := metadataMessage{}
+	err := d.Decode(&msg)
+	if err != nil {
+		return 0, err
+	}
+	if msg.MsgType == msgReject {
+		return 0, fmt.Errorf("Peer rejected metadata piece %d", msg.Piece)
+	}
+	if msg.MsgType != msgData {
+		return -1, nil
+	}
+
+	data := payload[d.InputOffset():]
+	begin := msg.Piece * BlockSize
+	if msg.Piece < 0 || begin >= len(buf) {
+		return 0, fmt.Errorf("Metadata piece %d out of range", msg.Piece)
+	}
+	expected := BlockSize
+	if len(buf)-begin < expected {
+		expected = len(buf) - begin
+	}
+	if len(data) != expected {
+		return 0, fmt.Errorf("Metadata piece %d has length %d, expected %d", msg.Piece, len(data), expected)
+	}
+	copy(buf[begin:], data)
+	return msg.Piece, nil
+}
@@ -0,0 +1,143 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/cedrickchee/min-torrent/bencode"
+	"github.com/cedrickchee/min-torrent/handshake"
+	"github.com/cedrickchee/min-torrent/message"
+	"github.com/cedrickchee/min-torrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveMetadata runs a peer that hands out info over ut_metadata
+func serveMetadata(t *testing.T, info []byte) peers.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := handshake.Read(conn)
+		if err != nil || !req.SupportsExtensions() {
+			return
+		}
+		res := handshake.New(req.InfoHash, [20]byte{'s', 'e', 'r', 'v', 'e', 'r'})
+		res.EnableExtensions()
+		conn.Write(res.Serialize())
+		conn.Write((&message.Message{ID: message.MsgBitfield, Payload: []byte{0xff}}).Serialize())
+
+		// The remote tells us which ID to use for its ut_metadata messages
+		var remoteID uint8
+		for {
+			msg, err := message.Read(conn)
+			if err != nil {
+				return
+			}
+			id, payload, err := message.ParseExtended(msg)
+			if err != nil {
+				return
+			}
+			if id == 0 {
+				hs := extendedHandshake{}
+				bencode.Unmarshal(payload, &hs)
+				remoteID = uint8(hs.M["ut_metadata"])
+				ours, _ := bencode.Marshal(extendedHandshake{
+					M:            map[string]int{"ut_metadata": 3},
+					MetadataSize: len(info),
+				})
+				conn.Write(message.FormatExtended(0, ours).Serialize())
+				continue
+			}
+			if id != 3 {
+				return
+			}
+			mm := metadataMessage{}
+			bencode.Unmarshal(payload, &mm)
+			begin := mm.Piece * BlockSize
+			end := begin + BlockSize
+			if end > len(info) {
+				end = len(info)
+			}
+			header, _ := bencode.Marshal(metadataMessage{MsgType: msgData, Piece: mm.Piece, TotalSize: len(info)})
+			conn.Write(message.FormatExtended(remoteID, append(header, info[begin:end]...)).Serialize())
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestFetch(t *testing.T) {
+	// Big enough to span several metadata pieces
+	info := []byte("d4:name5:a.txt6:pieces" + "40000:" + strings.Repeat("x", 40000) + "e")
+	infoHash := sha1.Sum(info)
+	peer := serveMetadata(t, info)
+
+	buf, err := Fetch([]peers.Peer{peer}, [20]byte{'c', 'l', 'i', 'e', 'n', 't'}, infoHash)
+	require.Nil(t, err)
+	assert.Equal(t, info, buf)
+}
+
+func TestFetchWrongHash(t *testing.T) {
+	info := []byte("d4:name5:a.txte")
+	peer := serveMetadata(t, info)
+
+	// The peer serves metadata for a different torrent than the one we want
+	_, err := Fetch([]peers.Peer{peer}, [20]byte{}, [20]byte{1, 2, 3})
+	assert.NotNil(t, err)
+}
+
+func TestParseMetadataPiece(t *testing.T) {
+	tests := map[string]struct {
+		payload string
+		bufLen  int
+		output  int
+		fails   bool
+	}{
+		"data message": {
+			payload: "d8:msg_typei1e5:piecei0e10:total_sizei3ee" + "abc",
+			bufLen:  3,
+			output:  0,
+			fails:   false,
+		},
+		"reject message": {
+			payload: "d8:msg_typei2e5:piecei0ee",
+			bufLen:  3,
+			output:  0,
+			fails:   true,
+		},
+		"piece out of range": {
+			payload: "d8:msg_typei1e5:piecei1e10:total_sizei3ee" + "abc",
+			bufLen:  3,
+			output:  0,
+			fails:   true,
+		},
+		"wrong data length": {
+			payload: "d8:msg_typei1e5:piecei0e10:total_sizei3ee" + "ab",
+			bufLen:  3,
+			output:  0,
+			fails:   true,
+		},
+	}
+
+	for _, test := range tests {
+		buf := make([]byte, test.bufLen)
+		piece, err := parseMetadataPiece([]byte(test.payload), buf)
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.output, piece)
+	}
+}
@@ -0,0 +1,270 @@
+package p2p
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/client"
+)
+
+// Choking (BEP 3): every chokeInterval the peers we upload to are chosen
+// again by rate, and every optimisticInterval a random peer is unchoked
+// to discover peers that could offer better rates
+const (
+	chokeInterval      = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+	uploadSlots        = 4 // peers unchoked at once, including the optimistic one
+)
+
+// peerConn is a connection to a peer, along with the state the choker
+// needs. Whether the peer is choking us and the pieces it has are kept in
+// c.Choked and c.Bitfield.
+type peerConn struct {
+	t        *Torrent
+	c        *client.Client
+	uploader *uploader
+	picker   *picker
+	results  chan *pieceResult
+	closed   chan struct{} // the torrent's
+
+	// Download state, shared by the message handlers and poll
+	dlMu      sync.Mutex // guards c.Choked, c.Bitfield, pipeline, lastBlock and err
+	pipeline  *pipeline
+	lastBlock time.Time // when a block last arrived, or we last weren't waiting for one
+	err       error     // why poll dropped the peer
+
+	mu             sync.Mutex
+	amChoking      bool
+	amInterested   bool
+	peerInterested bool
+
+	downloaded int64 // bytes received from the peer, updated atomically
+
+	// Rates measured by the choker
+	lastDownloaded int64
+	lastUploaded   int64
+	downloadRate   float64 // bytes per second
+	uploadRate     float64 // bytes per second
+}
+
+// newPeerConn returns a connection to a peer. t.mu must be held.
+func newPeerConn(t *Torrent, c *client.Client, picker *picker, results chan *pieceResult) *peerConn {
+	return &peerConn{
+		t:         t,
+		c:         c,
+		uploader:  newUploader(t, c),
+		picker:    picker,
+		results:   results,
+		closed:    t.closed,
+		pipeline:  newPipeline(),
+		lastBlock: time.Now(),
+		amChoking: true,
+	}
+}
+
+// isChoking tells if we are choking the peer
+func (pc *peerConn) isChoking() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.amChoking
+}
+
+func (pc *peerConn) isInterested() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.peerInterested
+}
+
+// setPeerInterested records an Interested or NotInterested message.
+// Returns true if the peer's interest changed.
+func (pc *peerConn) setPeerInterested(interested bool) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	changed := pc.peerInterested != interested
+	pc.peerInterested = interested
+	return changed
+}
+
+// setInterested tells the peer whether we want pieces it has
+func (pc *peerConn) setInterested(interested bool) error {
+	pc.mu.Lock()
+	if pc.amInterested == interested {
+		pc.mu.Unlock()
+		return nil
+	}
+	pc.amInterested = interested
+	pc.mu.Unlock()
+
+	if interested {
+		return pc.c.SendInterested()
+	}
+	return pc.c.SendNotInterested()
+}
+
+// setChoking chokes or unchokes the peer. Requests still queued when the
+// peer is choked are discarded, as the peer expects.
+func (pc *peerConn) setChoking(choke bool) error {
+	pc.mu.Lock()
+	if pc.amChoking == choke {
+		pc.mu.Unlock()
+		return nil
+	}
+	pc.amChoking = choke
+	pc.mu.Unlock()
+
+	if choke {
+		pc.uploader.clear()
+		return pc.c.SendChoke()
+	}
+	return pc.c.SendUnchoke()
+}
+
+// measure updates the peer's transfer rates over the elapsed interval
+func (pc *peerConn) measure(elapsed time.Duration) {
+	downloaded := atomic.LoadInt64(&pc.downloaded)
+	uploaded := atomic.LoadInt64(&pc.uploader.uploaded)
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.downloadRate = float64(downloaded-pc.lastDownloaded) / elapsed.Seconds()
+	pc.uploadRate = float64(uploaded-pc.lastUploaded) / elapsed.Seconds()
+	pc.lastDownloaded = downloaded
+	pc.lastUploaded = uploaded
+}
+
+func (pc *peerConn) rates() (download, upload float64) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.downloadRate, pc.uploadRate
+}
+
+// startChoker starts choosing which peers to upload to, once
+func (t *Torrent) startChoker() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed == nil {
+		t.closed = make(chan struct{})
+	}
+	if t.rechokeNow != nil {
+		return
+	}
+	t.rechokeNow = make(chan struct{}, 1)
+	go t.runChoker(t.rechokeNow, t.closed)
+}
+
+// requestRechoke runs a choke round soon, without waiting for the next
+// interval, so a newly interested peer can take a free upload slot
+func (t *Torrent) requestRechoke() {
+	t.mu.Lock()
+	rechokeNow := t.rechokeNow
+	t.mu.Unlock()
+	if rechokeNow == nil {
+		return
+	}
+	select {
+	case rechokeNow <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Torrent) runChoker(rechokeNow, closed chan struct{}) {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	rounds := int(optimisticInterval / chokeInterval)
+	last := time.Now()
+	rng := rand.New(rand.NewSource(last.UnixNano()))
+	for round := 0; ; {
+		select {
+		case now := <-ticker.C:
+			for _, pc := range t.connections() {
+				pc.measure(now.Sub(last))
+			}
+			last = now
+			t.rechoke(rng, round%rounds == 0)
+			round++
+		case <-rechokeNow:
+			t.rechoke(rng, false)
+		case <-closed:
+			return
+		}
+	}
+}
+
+// rechoke unchokes the interested peers with the best rates: those we
+// download from fastest while leeching, or upload to fastest while
+// seeding. One more slot goes to the optimistic unchoke, which moves to
+// another random peer when rotate is set.
+func (t *Torrent) rechoke(rng *rand.Rand, rotate bool) {
+	conns := t.connections()
+	t.mu.Lock()
+	seeding := t.complete()
+	optimistic := t.optimistic
+	t.mu.Unlock()
+
+	var candidates []*peerConn
+	for _, pc := range conns {
+		if pc.isInterested() {
+			candidates = append(candidates, pc)
+		}
+	}
+	rate := func(pc *peerConn) float64 {
+		download, upload := pc.rates()
+		if seeding {
+			return upload
+		}
+		return download
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rate(candidates[i]) > rate(candidates[j])
+	})
+
+	unchoke := make(map[*peerConn]bool)
+	for i := 0; i < len(candidates) && i < uploadSlots-1; i++ {
+		unchoke[candidates[i]] = true
+	}
+
+	eligible := false // the optimistic peer may keep its slot
+	for _, pc := range candidates {
+		if pc == optimistic && !unchoke[pc] {
+			eligible = true
+		}
+	}
+	if !eligible || rotate {
+		previous := optimistic
+		optimistic = nil
+		var others []*peerConn
+		for _, pc := range candidates {
+			if !unchoke[pc] && pc != previous {
+				others = append(others, pc)
+			}
+		}
+		if len(others) > 0 {
+			optimistic = others[rng.Intn(len(others))]
+		} else if eligible {
+			optimistic = previous // there is nobody else to move to
+		}
+	}
+	if optimistic != nil {
+		unchoke[optimistic] = true
+	}
+
+	t.mu.Lock()
+	t.optimistic = optimistic
+	t.mu.Unlock()
+	for _, pc := range conns {
+		pc.setChoking(!unchoke[pc])
+	}
+}
+
+// connections returns the peers we are connected to
+func (t *Torrent) connections() []*peerConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := make([]*peerConn, 0, len(t.conns))
+	for pc := range t.conns {
+		conns = append(conns, pc)
+	}
+	return conns
+}
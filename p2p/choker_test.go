@@ -0,0 +1,129 @@
+package p2p
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/cedrickchee/min-torrent/bitfield"
+	"github.com/cedrickchee/min-torrent/client"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPeer struct {
+	interested               bool
+	downloadRate, uploadRate float64
+}
+
+// newChokerTorrent returns a torrent of one piece connected to peers whose
+// rates are already measured. Messages to the peers are queued and never
+// read; closing the torrent releases them.
+func newChokerTorrent(seeding bool, peers []testPeer) (*Torrent, []*peerConn) {
+	t := &Torrent{
+		PieceHashes: make([][20]byte, 1),
+		PieceLength: 1,
+		Length:      1,
+		have:        bitfield.New(1),
+		conns:       make(map[*peerConn]bool),
+	}
+	if seeding {
+		t.have.SetPiece(0)
+	}
+	var conns []*peerConn
+	for _, peer := range peers {
+		local, _ := net.Pipe()
+		c := &client.Client{Conn: local}
+		c.Start()
+		pc := newPeerConn(t, c, nil, nil)
+		pc.peerInterested = peer.interested
+		pc.downloadRate = peer.downloadRate
+		pc.uploadRate = peer.uploadRate
+		t.conns[pc] = true
+		conns = append(conns, pc)
+	}
+	return t, conns
+}
+
+func TestRechoke(t *testing.T) {
+	tests := map[string]struct {
+		seeding    bool
+		peers      []testPeer
+		byRate     []int // peers unchoked for their rate
+		optimistic []int // peers that may be unchoked optimistically
+	}{
+		"leeching ranks by download rate": {
+			seeding: false,
+			peers: []testPeer{
+				{true, 50, 1}, {true, 40, 2}, {true, 30, 3}, {true, 20, 4}, {true, 10, 5},
+				{false, 100, 100},
+			},
+			byRate:     []int{0, 1, 2},
+			optimistic: []int{3, 4},
+		},
+		"seeding ranks by upload rate": {
+			seeding: true,
+			peers: []testPeer{
+				{true, 50, 1}, {true, 40, 2}, {true, 30, 3}, {true, 20, 4}, {true, 10, 5},
+				{false, 100, 100},
+			},
+			byRate:     []int{4, 3, 2},
+			optimistic: []int{0, 1},
+		},
+		"fewer interested peers than slots": {
+			seeding: false,
+			peers: []testPeer{
+				{true, 10, 0}, {false, 50, 0}, {true, 0, 0},
+			},
+			byRate:     []int{0, 2},
+			optimistic: nil,
+		},
+	}
+
+	for name, test := range tests {
+		tr, conns := newChokerTorrent(test.seeding, test.peers)
+		tr.rechoke(rand.New(rand.NewSource(1)), true)
+
+		var unchoked []int
+		for i, pc := range conns {
+			if !pc.isChoking() {
+				unchoked = append(unchoked, i)
+			}
+		}
+		optimistic := -1
+		for i, pc := range conns {
+			if pc == tr.optimistic {
+				optimistic = i
+			}
+		}
+		if test.optimistic == nil {
+			assert.Equal(t, -1, optimistic, name)
+			assert.ElementsMatch(t, test.byRate, unchoked, name)
+		} else {
+			assert.Contains(t, test.optimistic, optimistic, name)
+			assert.ElementsMatch(t, append(test.byRate, optimistic), unchoked, name)
+		}
+		assert.True(t, len(unchoked) <= uploadSlots, name)
+		tr.Close()
+	}
+}
+
+func TestRechokeOptimistic(t *testing.T) {
+	tr, conns := newChokerTorrent(false, []testPeer{
+		{true, 50, 0}, {true, 40, 0}, {true, 30, 0}, {true, 20, 0}, {true, 10, 0},
+	})
+	defer tr.Close()
+	rng := rand.New(rand.NewSource(1))
+	tr.optimistic = conns[4]
+
+	// Between rotations, the optimistic peer keeps its slot
+	tr.rechoke(rng, false)
+	assert.Equal(t, conns[4], tr.optimistic)
+	assert.False(t, conns[4].isChoking())
+	assert.True(t, conns[3].isChoking())
+
+	// On rotation, it moves to another peer
+	tr.rechoke(rng, true)
+	assert.Equal(t, conns[3], tr.optimistic)
+	assert.False(t, conns[3].isChoking())
+	assert.True(t, conns[4].isChoking())
+}
@@ -0,0 +1,43 @@
+package p2p
+
+import (
+	"github.com/cedrickchee/min-torrent/bencode"
+)
+
+// extendedHandshakeID is the extended message ID of the handshake that
+// starts the extension protocol (BEP 10)
+const extendedHandshakeID = 0
+
+// extendedHandshake is the dictionary peers exchange in the extended
+// handshake. We don't offer any extension messages on these connections,
+// but the handshake tells how many requests each side will queue.
+type extendedHandshake struct {
+	M    map[string]int `bencode:"m"`
+	Reqq int            `bencode:"reqq,omitempty"` // requests queued without dropping any
+}
+
+// sendExtendedHandshake tells the peer how many of its requests we queue
+func sendExtendedHandshake(pc *peerConn) error {
+	payload, err := bencode.Marshal(extendedHandshake{
+		M:    map[string]int{},
+		Reqq: maxUploadQueue,
+	})
+	if err != nil {
+		return err
+	}
+	return pc.c.SendExtended(extendedHandshakeID, payload)
+}
+
+// parseExtendedHandshake returns the number of requests the peer queues,
+// or 0 if it doesn't say
+func parseExtendedHandshake(payload []byte) (int, error) {
+	var hs extendedHandshake
+	err := bencode.Unmarshal(payload, &hs)
+	if err != nil {
+		return 0, err
+	}
+	if hs.Reqq < 0 {
+		return 0, nil
+	}
+	return hs.Reqq, nil
+}
@@ -3,21 +3,32 @@ package p2p
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cedrickchee/min-torrent/bitfield"
 	"github.com/cedrickchee/min-torrent/client"
-	"github.com/cedrickchee/min-torrent/message"
+	"github.com/cedrickchee/min-torrent/handshake"
 	"github.com/cedrickchee/min-torrent/peers"
+	"github.com/cedrickchee/min-torrent/storage"
 )
 
 // MaxBlockSize is the largest number of bytes a request can ask for
 const MaxBlockSize = 16384
 
-// MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
-const MaxBacklog = 5
+// waitPoll is how often requests pending with a peer are topped up, as
+// blocks may become free to request, say because another peer dropped
+const waitPoll = time.Second
+
+// snubTimeout is how long a peer may go without sending any of the blocks
+// it was asked for. 30 seconds is more than enough time to get a few.
+const snubTimeout = 30 * time.Second
 
 // Torrent holds data required to download a torrent from a list of peers
 type Torrent struct {
@@ -28,6 +39,32 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Storage     storage.Torrent   // where the torrent's content is read and written
+	Have        bitfield.Bitfield // pieces already in storage, which won't be downloaded
+
+	downloaded int64 // bytes of verified pieces, updated atomically
+	uploaded   int64 // bytes sent to peers, updated atomically
+
+	mu      sync.Mutex
+	have    bitfield.Bitfield // pieces we have verified
+	started bool              // Download or Seed was called
+	known   map[string]bool   // peers we already have a worker for
+	running bool
+	picker  *picker
+	results chan *pieceResult
+
+	conns      map[*peerConn]bool // every connected peer
+	optimistic *peerConn          // the optimistically unchoked peer
+	rechokeNow chan struct{}
+	closed     chan struct{}
+	peers      sync.WaitGroup // runPeer calls in progress
+}
+
+// Stats holds the transfer counters reported to trackers
+type Stats struct {
+	Downloaded int64
+	Uploaded   int64
+	Left       int64
 }
 
 type pieceWork struct {
@@ -41,159 +78,310 @@ type pieceResult struct {
 	buf   []byte
 }
 
-type downloadState struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
-}
-
-// Download downloads a torrent.
-// This stores the entire file in memory.
-func (t *Torrent) Download() ([]byte, error) {
+// Download downloads a torrent. Each piece is written to storage as soon
+// as it is verified.
+func (t *Torrent) Download() error {
 	log.Println("Starting download for", t.Name)
 	numPieces := len(t.PieceHashes)
 
-	// Init queues for workers to retrieve work and send results
-	workQueue := make(chan *pieceWork, numPieces)
-	results := make(chan *pieceResult)
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
-	}
+	have := bitfield.New(numPieces)
+	copy(have, t.Have)
 
-	// Start workers
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	donePieces := 0
+	for index := range t.PieceHashes {
+		if have.HasPiece(index) {
+			donePieces++
+		}
+	}
+	if donePieces > 0 {
+		log.Printf("Resuming with %d of %d pieces\n", donePieces, numPieces)
 	}
 
-	// Collect results into a buffer until full
-	buf := make([]byte, t.Length)
-	donePieces := 0
+	// Start workers, which pick the pieces to download and send results
+	picker := newPicker(numPieces, t.calculatePieceSize, have)
+	results := make(chan *pieceResult)
+	t.mu.Lock()
+	t.have = have
+	t.started = true
+	t.picker = picker
+	t.results = results
+	t.running = true
+	t.mu.Unlock()
+	t.startChoker()
+	t.AddPeers(t.Peers)
+
+	// Write results to storage until every piece is done
 	for donePieces < numPieces {
-		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
+		var res *pieceResult
+		select {
+		case res = <-results:
+		case <-t.closed:
+			return errors.New("Torrent was closed")
+		}
+		piece := t.Storage.Piece(res.index)
+		_, err := piece.WriteAt(res.buf, 0)
+		if err != nil {
+			return err
+		}
+		err = piece.MarkComplete()
+		if err != nil {
+			return err
+		}
 		donePieces++
+		t.mu.Lock()
+		t.have.SetPiece(res.index)
+		have := t.bitfield()
+		t.mu.Unlock()
+		picker.complete(res.index)
+		t.broadcastHave(res.index, have)
+		atomic.AddInt64(&t.downloaded, int64(len(res.buf)))
 
 		percent := float64(donePieces) / float64(numPieces) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+		numPeers := len(t.connections())
+		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numPeers)
 	}
-	close(workQueue)
+	t.mu.Lock()
+	t.running = false
+	t.mu.Unlock()
 
-	return buf, nil
+	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.New(peer, t.PeerID, t.InfoHash)
-	if err != nil {
-		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
-		return
+// AddPeers starts downloading from peers we aren't connected to yet.
+// Peers added before Download is called are used once it starts.
+func (t *Torrent) AddPeers(peerList []peers.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.known == nil {
+		t.known = make(map[string]bool)
 	}
-	defer c.Conn.Close()
-	log.Printf("Completed handshake with %s\n", peer.IP)
-
-	c.SendUnchoke()
-	c.SendInterested()
-
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			// Re-enqueue the piece to try again
-			workQueue <- pw // Put piece back on the queue
+	for _, peer := range peerList {
+		if t.known[peer.String()] {
 			continue
 		}
-
-		// Download the piece
-		buf, err := attemptDownloadPiece(c, pw)
-		if err != nil {
-			log.Println("Exiting", err)
-			workQueue <- pw // Put piece back on the queue
-			return
+		if !t.running {
+			t.Peers = append(t.Peers, peer)
+			continue
 		}
+		t.known[peer.String()] = true
+		go t.startDownloadWorker(peer, t.picker, t.results)
+	}
+}
 
-		err = checkIntegrity(pw, buf)
-		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.index)
-			workQueue <- pw // Put piece back on the queue
-			continue
+// Stats returns the torrent's transfer counters
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+	have := t.have
+	if have == nil {
+		have = t.Have
+	}
+	left := int64(0)
+	for i := range t.PieceHashes {
+		if !have.HasPiece(i) {
+			left += int64(t.calculatePieceSize(i))
 		}
+	}
+	t.mu.Unlock()
+	return Stats{
+		Downloaded: atomic.LoadInt64(&t.downloaded),
+		Uploaded:   atomic.LoadInt64(&t.uploaded),
+		Left:       left,
+	}
+}
+
+// Bitfield returns the pieces we have verified
+func (t *Torrent) Bitfield() bitfield.Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.have == nil {
+		bf := bitfield.New(len(t.PieceHashes))
+		copy(bf, t.Have)
+		return bf
+	}
+	return t.bitfield()
+}
+
+// Verify checks the data in storage against the piece hashes, hashing on
+// the given number of goroutines, and returns the pieces that are intact.
+// Pieces that can't be read are missing.
+func (t *Torrent) Verify(workers int) bitfield.Bitfield {
+	if workers < 1 {
+		workers = 1
+	}
+	indexes := make(chan int, len(t.PieceHashes))
+	for index := range t.PieceHashes {
+		indexes <- index
+	}
+	close(indexes)
 
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
-	}
-}
-
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	pieceLength := pw.length
-	state := downloadState{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pieceLength),
-	}
-
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 262 KB piece.
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{})
-
-	for state.downloaded < pieceLength {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
-			for state.requested < pieceLength && state.backlog < MaxBacklog {
-				blockSize := MaxBlockSize
-				if pieceLength-state.requested < blockSize {
-					// Last block might be shorter than the typical block
-					blockSize = pieceLength - state.requested
-				}
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
+	intact := make([]bool, len(t.PieceHashes))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				intact[index] = t.verifyPiece(index)
 			}
+		}()
+	}
+	wg.Wait()
+
+	have := bitfield.New(len(t.PieceHashes))
+	for index, ok := range intact {
+		if ok {
+			have.SetPiece(index)
 		}
+	}
+	return have
+}
 
-		err := state.readMessage()
-		if err != nil {
-			return nil, err
+func (t *Torrent) verifyPiece(index int) bool {
+	length := t.calculatePieceSize(index)
+	buf := make([]byte, length)
+	_, err := t.Storage.Piece(index).ReadAt(buf, 0)
+	if err != nil {
+		return false
+	}
+	return checkIntegrity(&pieceWork{index, t.PieceHashes[index], length}, buf) == nil
+}
+
+// Seed shares data already in storage. The data is checked against the
+// piece hashes first, then peers that connect to us are uploaded to until
+// Close is called. We don't connect to peers ourselves.
+func (t *Torrent) Seed() error {
+	have := t.Verify(runtime.NumCPU())
+	for index := range t.PieceHashes {
+		if !have.HasPiece(index) {
+			return fmt.Errorf("Index %d failed integrity check", index)
 		}
 	}
+	log.Println("Seeding", t.Name)
+
+	t.mu.Lock()
+	t.have = have
+	t.started = true
+	t.picker = newPicker(len(t.PieceHashes), t.calculatePieceSize, have) // nothing to download
+	t.mu.Unlock()
+	t.startChoker()
+	return nil
+}
 
-	return state.buf, nil
+// Close disconnects from every peer and stops uploading. It returns once
+// no peer goroutine uses the storage anymore, so it can then be closed.
+func (t *Torrent) Close() {
+	t.mu.Lock()
+	if t.closed == nil {
+		t.closed = make(chan struct{})
+	}
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+		for pc := range t.conns {
+			pc.c.Close()
+		}
+	}
+	t.mu.Unlock()
+	t.peers.Wait()
 }
 
-func (state *downloadState) readMessage() error {
-	msg, err := state.client.Read() // this call blocks
+// HandlePeer takes over an incoming connection whose handshake asked for
+// this torrent. Once our handshake and bitfield are sent, the peer is
+// downloaded from and uploaded to like the peers we connect to ourselves.
+func (t *Torrent) HandlePeer(conn net.Conn, remote *handshake.Handshake) {
+	if remote.PeerID == t.PeerID {
+		conn.Close() // we connected to ourselves
+		return
+	}
+
+	t.mu.Lock()
+	started := t.started
+	picker, results := t.picker, t.results
+	bf := t.bitfield()
+	t.mu.Unlock()
+	if !started {
+		conn.Close()
+		return
+	}
+
+	c, err := client.Accept(conn, remote, t.PeerID, t.InfoHash, bf, len(t.PieceHashes))
 	if err != nil {
-		return err
-	}
-	if msg == nil { // keep-alive
-		return nil
-	}
-	switch msg.ID {
-	case message.MsgUnchoke:
-		state.client.Choked = false
-	case message.MsgChoke:
-		state.client.Choked = true
-	case message.MsgHave:
-		index, err := message.ParseHave(msg)
-		if err != nil {
-			return err
+		log.Printf("Could not handshake with %s. Disconnecting\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	defer c.Close()
+	log.Printf("Accepted connection from %s\n", conn.RemoteAddr())
+
+	t.runPeer(c, bf, picker, results)
+}
+
+// complete tells if we have every piece. t.mu must be held.
+func (t *Torrent) complete() bool {
+	for i := range t.PieceHashes {
+		if !t.have.HasPiece(i) {
+			return false
 		}
-		state.client.Bitfield.SetPiece(index)
-	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
-		if err != nil {
-			return err
+	}
+	return true
+}
+
+// bitfield returns a copy of the pieces we have. t.mu must be held.
+func (t *Torrent) bitfield() bitfield.Bitfield {
+	bf := bitfield.New(len(t.PieceHashes))
+	copy(bf, t.have)
+	return bf
+}
+
+func (t *Torrent) startDownloadWorker(peer peers.Peer, picker *picker, results chan *pieceResult) {
+	c, err := client.New(peer, t.PeerID, t.InfoHash, len(t.PieceHashes))
+	if err != nil {
+		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
+		return
+	}
+	defer c.Close()
+	log.Printf("Completed handshake with %s\n", peer.IP)
+
+	t.mu.Lock()
+	bf := t.bitfield()
+	t.mu.Unlock()
+	c.SendBitfield(bf)
+
+	t.runPeer(c, bf, picker, results)
+}
+
+// addConn registers a connected peer with the choker. Returns false if
+// the torrent was closed.
+func (t *Torrent) addConn(c *client.Client, picker *picker, results chan *pieceResult) (*peerConn, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed != nil {
+		select {
+		case <-t.closed:
+			return nil, false
+		default:
 		}
-		state.downloaded += n
-		state.backlog--
 	}
-	return nil
+	if t.conns == nil {
+		t.conns = make(map[*peerConn]bool)
+	}
+	pc := newPeerConn(t, c, picker, results)
+	t.conns[pc] = true
+	t.peers.Add(1)
+	return pc, true
+}
+
+func (t *Torrent) removeConn(pc *peerConn) {
+	t.mu.Lock()
+	delete(t.conns, pc)
+	if t.optimistic == pc {
+		t.optimistic = nil
+	}
+	t.mu.Unlock()
+	if pc.isInterested() && !pc.isChoking() {
+		t.requestRechoke() // an upload slot is free
+	}
 }
 
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
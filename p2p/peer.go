@@ -0,0 +1,314 @@
+package p2p
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/bitfield"
+	"github.com/cedrickchee/min-torrent/client"
+	"github.com/cedrickchee/min-torrent/message"
+)
+
+// runPeer exchanges blocks with a connected peer until the connection
+// fails. Messages are handled as soon as they arrive while requests for
+// the blocks the picker gives out stay pending, so the peer's requests are
+// answered even while we download from it. sent is the bitfield we sent
+// the peer.
+func (t *Torrent) runPeer(c *client.Client, sent bitfield.Bitfield, picker *picker, results chan *pieceResult) {
+	c.Start()
+	pc, ok := t.addConn(c, picker, results)
+	if !ok {
+		return
+	}
+	defer t.peers.Done()
+	defer t.removeConn(pc)
+	go pc.uploader.run()
+	defer pc.uploader.stop()
+
+	picker.addPeer(c.Bitfield)
+	defer func() {
+		picker.removePeer(c.Bitfield)
+	}()
+	defer picker.release(pc)
+
+	if c.Extensions {
+		sendExtendedHandshake(pc)
+	}
+
+	// Pieces verified from now on are announced by broadcastHave
+	have := t.Bitfield()
+	for index := range t.PieceHashes {
+		if have.HasPiece(index) && !sent.HasPiece(index) {
+			c.SendHave(index)
+		}
+	}
+	pc.dlMu.Lock()
+	pc.updateInterest(have)
+	pc.dlMu.Unlock()
+
+	done := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		pc.poll(done)
+		close(polled)
+	}()
+	err := c.Run(pc.handle)
+	c.Close() // unblocks the uploader if it waits on the connection
+	close(done)
+	<-polled
+
+	if pc.err != nil {
+		err = pc.err
+	}
+	log.Printf("Disconnecting from %s: %v\n", c.Conn.RemoteAddr(), err)
+}
+
+// poll tops up the requests pending with the peer every waitPoll until
+// done is closed. A peer that stops sending the blocks it was asked for is
+// disconnected.
+func (pc *peerConn) poll(done <-chan struct{}) {
+	ticker := time.NewTicker(waitPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		pc.dlMu.Lock()
+		err := pc.requestBlocks()
+		if err == nil && time.Since(pc.lastBlock) > snubTimeout {
+			err = errors.New("Peer stopped sending blocks")
+		}
+		if err != nil && pc.err == nil {
+			pc.err = err
+		}
+		pc.dlMu.Unlock()
+		if err != nil {
+			pc.c.Close() // makes Run return
+			return
+		}
+	}
+}
+
+// requestBlocks sends requests for the blocks the picker gives out until
+// there are enough pending for the peer's throughput. pc.dlMu must be held.
+func (pc *peerConn) requestBlocks() error {
+	if !pc.c.Choked {
+		for pc.picker.inflightFor(pc) < pc.pipeline.size() {
+			index, begin, length, ok := pc.picker.nextRequest(pc, pc.c.Bitfield)
+			if !ok {
+				break
+			}
+			err := pc.c.SendRequest(index, begin, length)
+			if err != nil {
+				return err
+			}
+			pc.pipeline.requested(blockRequest{index, begin, length}, time.Now())
+		}
+	}
+	if pc.picker.inflightFor(pc) == 0 {
+		pc.lastBlock = time.Now() // not waiting on the peer
+		pc.pipeline.reset()
+	}
+	return nil
+}
+
+// updateInterest tells the peer whether we are interested, that is if it
+// has a piece missing from have. pc.dlMu must be held.
+func (pc *peerConn) updateInterest(have bitfield.Bitfield) error {
+	for index := range pc.t.PieceHashes {
+		if pc.c.Bitfield.HasPiece(index) && !have.HasPiece(index) {
+			return pc.setInterested(true)
+		}
+	}
+	return pc.setInterested(false)
+}
+
+// broadcastHave announces a piece we verified to every connected peer, and
+// tells the peers that have nothing else we need that we are no longer
+// interested. have holds the pieces we have, including the new one.
+func (t *Torrent) broadcastHave(index int, have bitfield.Bitfield) {
+	for _, pc := range t.connections() {
+		pc.c.SendHave(index)
+		pc.dlMu.Lock()
+		if pc.c.Bitfield.HasPiece(index) {
+			pc.updateInterest(have)
+		}
+		pc.dlMu.Unlock()
+	}
+}
+
+// handle dispatches a message read from the peer to its handler
+func (pc *peerConn) handle(msg *message.Message) error {
+	if msg == nil {
+		return nil // keep-alive
+	}
+	switch msg.ID {
+	case message.MsgChoke:
+		pc.onChoke()
+	case message.MsgUnchoke:
+		return pc.onUnchoke()
+	case message.MsgInterested, message.MsgNotInterested:
+		pc.onInterested(msg.ID == message.MsgInterested)
+	case message.MsgBitfield, message.MsgHaveAll, message.MsgHaveNone:
+		return pc.onBitfield(msg)
+	case message.MsgHave:
+		return pc.onHave(msg)
+	case message.MsgRequest:
+		return pc.onRequest(msg)
+	case message.MsgCancel:
+		return pc.onCancel(msg)
+	case message.MsgPiece:
+		return pc.onPiece(msg)
+	case message.MsgExtended:
+		return pc.onExtended(msg)
+	}
+	return nil
+}
+
+func (pc *peerConn) onChoke() {
+	pc.dlMu.Lock()
+	defer pc.dlMu.Unlock()
+	pc.c.Choked = true
+	pc.picker.release(pc) // the peer discards our requests
+	pc.pipeline.reset()
+}
+
+func (pc *peerConn) onUnchoke() error {
+	pc.dlMu.Lock()
+	defer pc.dlMu.Unlock()
+	pc.c.Choked = false
+	return pc.requestBlocks()
+}
+
+func (pc *peerConn) onInterested(interested bool) {
+	if pc.setPeerInterested(interested) {
+		pc.t.requestRechoke()
+	}
+}
+
+// onBitfield records the pieces the peer announced in place of its initial
+// bitfield. A peer with no pieces may announce nothing at all, or only
+// send Have messages later. HaveAll and HaveNone are taken from peers that
+// send them even though we don't advertise the Fast extension.
+func (pc *peerConn) onBitfield(msg *message.Message) error {
+	pc.dlMu.Lock()
+	defer pc.dlMu.Unlock()
+	pc.picker.removePeer(pc.c.Bitfield)
+	err := pc.c.SetBitfield(msg)
+	pc.picker.addPeer(pc.c.Bitfield)
+	if err != nil {
+		return err
+	}
+	err = pc.updateInterest(pc.t.Bitfield())
+	if err != nil {
+		return err
+	}
+	return pc.requestBlocks()
+}
+
+func (pc *peerConn) onHave(msg *message.Message) error {
+	index, err := message.ParseHave(msg)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(pc.t.PieceHashes) {
+		return nil // out of range, including the spare bits of the bitfield
+	}
+	pc.dlMu.Lock()
+	defer pc.dlMu.Unlock()
+	if pc.c.Bitfield.HasPiece(index) {
+		return nil
+	}
+	pc.c.Bitfield.SetPiece(index)
+	pc.picker.addPiece(index)
+
+	pc.t.mu.Lock()
+	missing := !pc.t.have.HasPiece(index)
+	pc.t.mu.Unlock()
+	if missing {
+		err = pc.setInterested(true)
+		if err != nil {
+			return err
+		}
+	}
+	return pc.requestBlocks()
+}
+
+func (pc *peerConn) onRequest(msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if pc.isChoking() {
+		return nil // choked peers' requests are dropped
+	}
+	return pc.uploader.request(blockRequest{index, begin, length})
+}
+
+func (pc *peerConn) onCancel(msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	pc.uploader.cancel(blockRequest{index, begin, length})
+	return nil
+}
+
+// onPiece stores a block. If it was the last block of its piece, the piece
+// is verified and sent to results.
+func (pc *peerConn) onPiece(msg *message.Message) error {
+	index, begin, block, err := message.ParseBlock(msg)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&pc.downloaded, int64(len(block)))
+
+	pc.dlMu.Lock()
+	completed, err := pc.picker.receive(pc, index, begin, block)
+	if err == nil {
+		pc.lastBlock = time.Now()
+		pc.pipeline.received(blockRequest{index, begin, len(block)}, time.Now())
+		err = pc.requestBlocks()
+	}
+	pc.dlMu.Unlock()
+	if err != nil || completed == nil {
+		return err
+	}
+
+	pw := &pieceWork{completed.index, pc.t.PieceHashes[completed.index], len(completed.buf)}
+	err = checkIntegrity(pw, completed.buf)
+	if err != nil {
+		log.Printf("Piece #%d failed integrity check\n", pw.index)
+		pc.picker.fail(completed)
+		return nil
+	}
+	select {
+	case pc.results <- &pieceResult{pw.index, completed.buf}:
+	case <-pc.closed:
+		return errors.New("Torrent was closed")
+	}
+	return nil
+}
+
+func (pc *peerConn) onExtended(msg *message.Message) error {
+	extendedID, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+	if extendedID != extendedHandshakeID {
+		return nil // we don't offer any extension messages
+	}
+	reqq, err := parseExtendedHandshake(payload)
+	if err != nil {
+		return err
+	}
+	pc.dlMu.Lock()
+	defer pc.dlMu.Unlock()
+	pc.pipeline.setLimit(reqq)
+	return nil
+}
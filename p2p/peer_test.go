@@ -0,0 +1,153 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/bitfield"
+	"github.com/cedrickchee/min-torrent/client"
+	"github.com/cedrickchee/min-torrent/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiveAll returns the messages that arrive on msgs until none has for a
+// while
+func receiveAll(msgs <-chan *message.Message) []*message.Message {
+	var received []*message.Message
+	for {
+		select {
+		case msg := <-msgs:
+			received = append(received, msg)
+		case <-time.After(100 * time.Millisecond):
+			return received
+		}
+	}
+}
+
+func TestBroadcastHave(t *testing.T) {
+	tr := &Torrent{
+		PieceHashes: make([][20]byte, 3),
+		PieceLength: 1,
+		Length:      3,
+		have:        bitfield.New(3),
+		conns:       make(map[*peerConn]bool),
+	}
+	tr.have.SetPiece(0)
+
+	newPeer := func(pieces ...int) (*peerConn, <-chan *message.Message) {
+		pc, msgs := newFakePeer()
+		pc.t = tr
+		pc.amInterested = true
+		pc.c.Bitfield = bitfield.New(3)
+		for _, index := range pieces {
+			pc.c.Bitfield.SetPiece(index)
+		}
+		tr.conns[pc] = true
+		return pc, msgs
+	}
+	done, doneMsgs := newPeer(1)
+	defer done.c.Conn.Close()
+	more, moreMsgs := newPeer(1, 2)
+	defer more.c.Conn.Close()
+	none, noneMsgs := newPeer()
+	defer none.c.Conn.Close()
+
+	tr.have.SetPiece(1)
+	tr.broadcastHave(1, tr.Bitfield())
+
+	// A peer with nothing else we need is told we are no longer interested
+	assert.Equal(t, []*message.Message{
+		message.FormatHave(1),
+		{ID: message.MsgNotInterested, Payload: []byte{}},
+	}, receiveAll(doneMsgs))
+	assert.False(t, done.amInterested)
+
+	assert.Equal(t, []*message.Message{message.FormatHave(1)}, receiveAll(moreMsgs))
+	assert.True(t, more.amInterested)
+	assert.Equal(t, []*message.Message{message.FormatHave(1)}, receiveAll(noneMsgs))
+}
+
+func TestCloseWaitsForPeers(t *testing.T) {
+	tr, err := newUploadTorrent()
+	require.Nil(t, err)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(ioutil.Discard, remote)
+	c := &client.Client{Conn: local, Bitfield: bitfield.New(3)}
+
+	go tr.runPeer(c, tr.Bitfield(), newPicker(3, tr.calculatePieceSize, tr.Bitfield()), nil)
+	require.Eventually(t, func() bool {
+		return len(tr.connections()) == 1
+	}, time.Second, 10*time.Millisecond)
+	pc := tr.connections()[0]
+
+	// Once Close returns, nothing reads from the storage anymore
+	tr.Close()
+	assert.Empty(t, tr.connections())
+	select {
+	case <-pc.uploader.stopped:
+	default:
+		t.Error("Uploader is still running")
+	}
+	tr.Close()
+}
+
+func TestOnHave(t *testing.T) {
+	tests := map[string]struct {
+		index      int
+		accepted   bool
+		interested bool
+	}{
+		"piece": {
+			index:      2,
+			accepted:   true,
+			interested: true,
+		},
+		"spare bit of the last byte": {
+			index:      5,
+			accepted:   false,
+			interested: false,
+		},
+		"past the bitfield": {
+			index:      8,
+			accepted:   false,
+			interested: false,
+		},
+	}
+
+	for name, test := range tests {
+		tr := &Torrent{
+			PieceHashes: make([][20]byte, 3),
+			PieceLength: MaxBlockSize,
+			Length:      3 * MaxBlockSize,
+			have:        bitfield.New(3),
+		}
+		pc, _ := newFakePeer()
+		pc.t = tr
+		pc.picker = newTestPicker(3, MaxBlockSize)
+		pc.pipeline = newPipeline()
+		pc.c.Bitfield = bitfield.New(3)
+		pc.c.Choked = true
+
+		err := pc.onHave(message.FormatHave(test.index))
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.accepted, pc.c.Bitfield.HasPiece(test.index), name)
+		assert.Equal(t, test.accepted, !bytes.Equal(bitfield.New(3), pc.c.Bitfield), name)
+		available := 0
+		for _, n := range pc.picker.availability {
+			available += n
+		}
+		if test.accepted {
+			assert.Equal(t, 1, available, name)
+		} else {
+			assert.Equal(t, 0, available, name)
+		}
+		assert.Equal(t, test.interested, pc.amInterested, name)
+		pc.c.Conn.Close()
+	}
+}
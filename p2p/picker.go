@@ -0,0 +1,392 @@
+package p2p
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/bitfield"
+)
+
+// randomFirstPieces is how many pieces we pick at random before switching
+// to rarest first. Until we have a few pieces we have nothing to offer in
+// return, and a rare piece is the slowest one to get.
+const randomFirstPieces = 4
+
+type pieceState int
+
+const (
+	pieceWanted     pieceState = iota // no block downloaded or requested yet
+	pieceInProgress                   // some blocks are downloaded or requested
+	pieceDone                         // verified and written to storage
+)
+
+// picker chooses which blocks to request from each peer, keeping track of
+// how many connected peers have each piece.
+//
+// Pieces are downloaded block by block, so different blocks of a piece can
+// come from different peers, and the blocks of a partial piece are kept
+// when a peer drops. Blocks of pieces already started are requested first,
+// so that they are assembled and verified as soon as possible.
+//
+// Once every remaining block has been requested, the picker enters
+// endgame: the outstanding blocks are requested from every peer that has
+// them rather than wait on a slow one. As soon as a block arrives, the
+// other peers it was requested from are sent a Cancel.
+type picker struct {
+	mu            sync.Mutex
+	rng           *rand.Rand
+	pieceSize     func(index int) int
+	state         []pieceState
+	availability  []int // number of connected peers that have each piece
+	wanted        int   // pieces in the pieceWanted state
+	done          int   // pieces in the pieceDone state
+	progress      map[int]*pieceProgress
+	inflight      map[*peerConn]int // blocks requested from each peer that haven't arrived yet
+	totalInflight int               // blocks requested from all peers that haven't arrived yet
+	endgame       bool
+}
+
+// pieceProgress is a piece being downloaded
+type pieceProgress struct {
+	index     int
+	buf       []byte
+	received  []bool        // blocks received
+	left      int           // blocks not received yet
+	requested [][]*peerConn // peers each block not received yet was requested from
+}
+
+func newPicker(numPieces int, pieceSize func(index int) int, have bitfield.Bitfield) *picker {
+	p := &picker{
+		rng:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		pieceSize:    pieceSize,
+		state:        make([]pieceState, numPieces),
+		availability: make([]int, numPieces),
+		progress:     make(map[int]*pieceProgress),
+		inflight:     make(map[*peerConn]int),
+	}
+	for index := range p.state {
+		if have.HasPiece(index) {
+			p.state[index] = pieceDone
+			p.done++
+		} else {
+			p.wanted++
+		}
+	}
+	return p
+}
+
+// addPeer counts the pieces of a newly connected peer
+func (p *picker) addPeer(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := range p.availability {
+		if bf.HasPiece(index) {
+			p.availability[index]++
+		}
+	}
+}
+
+// removePeer stops counting the pieces of a peer that disconnected
+func (p *picker) removePeer(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := range p.availability {
+		if bf.HasPiece(index) {
+			p.availability[index]--
+		}
+	}
+}
+
+// addPiece counts a piece that a peer announced with a Have message
+func (p *picker) addPiece(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// nextRequest chooses the next block to request from a peer that has the
+// pieces in bf, and records the request. Returns false if the peer has no
+// block we need that we may request from it, or too many blocks are in
+// flight already across every torrent.
+func (p *picker) nextRequest(pc *peerConn, bf bitfield.Bitfield) (index, begin, length int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !reserveInflight() {
+		return 0, 0, 0, false
+	}
+
+	pp := p.startedPiece(bf)
+	if pp == nil {
+		pp = p.newPiece(bf)
+	}
+	block := -1
+	if pp != nil {
+		block = pp.unrequestedBlock()
+	} else if p.inEndgame() {
+		pp, block = p.endgameBlock(pc, bf)
+	}
+	if pp == nil {
+		releaseInflight(1)
+		return 0, 0, 0, false
+	}
+
+	pp.requested[block] = append(pp.requested[block], pc)
+	p.inflight[pc]++
+	p.totalInflight++
+	begin, length = pp.blockBounds(block)
+	return pp.index, begin, length, true
+}
+
+// startedPiece returns the piece in progress that the peer has and that
+// is the closest to completion, among those with a block nobody was asked
+// for. p.mu must be held.
+func (p *picker) startedPiece(bf bitfield.Bitfield) *pieceProgress {
+	var best *pieceProgress
+	bestLeft := 0
+	for _, pp := range p.progress {
+		if !bf.HasPiece(pp.index) || pp.unrequestedBlock() == -1 {
+			continue
+		}
+		left := pp.unrequestedBlocks()
+		if best == nil || left < bestLeft || (left == bestLeft && pp.index < best.index) {
+			best, bestLeft = pp, left
+		}
+	}
+	return best
+}
+
+// newPiece starts downloading a piece the peer has: a random one for the
+// first few pieces, then the rarest one. p.mu must be held.
+func (p *picker) newPiece(bf bitfield.Bitfield) *pieceProgress {
+	var candidates []int
+	rarest := 0
+	for index, state := range p.state {
+		if state != pieceWanted || !bf.HasPiece(index) {
+			continue
+		}
+		if p.done >= randomFirstPieces {
+			// Only keep the rarest pieces; ties are broken at random
+			if len(candidates) > 0 && p.availability[index] > rarest {
+				continue
+			}
+			if len(candidates) == 0 || p.availability[index] < rarest {
+				candidates = candidates[:0]
+				rarest = p.availability[index]
+			}
+		}
+		candidates = append(candidates, index)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	index := candidates[p.rng.Intn(len(candidates))]
+	length := p.pieceSize(index)
+	numBlocks := (length + MaxBlockSize - 1) / MaxBlockSize
+	pp := &pieceProgress{
+		index:     index,
+		buf:       make([]byte, length),
+		received:  make([]bool, numBlocks),
+		left:      numBlocks,
+		requested: make([][]*peerConn, numBlocks),
+	}
+	p.state[index] = pieceInProgress
+	p.progress[index] = pp
+	p.wanted--
+	return pp
+}
+
+// inEndgame tells if every block we still need has been requested. p.mu
+// must be held.
+func (p *picker) inEndgame() bool {
+	if p.wanted > 0 {
+		return false
+	}
+	for _, pp := range p.progress {
+		if pp.unrequestedBlock() != -1 {
+			return false
+		}
+	}
+	if !p.endgame {
+		p.endgame = true
+		log.Println("Entering endgame")
+	}
+	return true
+}
+
+// endgameBlock chooses an outstanding block to request from a peer again,
+// among those not requested from it yet, preferring the blocks requested
+// from the fewest peers. p.mu must be held.
+func (p *picker) endgameBlock(pc *peerConn, bf bitfield.Bitfield) (*pieceProgress, int) {
+	var best *pieceProgress
+	bestBlock := -1
+	for _, pp := range p.progress {
+		if !bf.HasPiece(pp.index) {
+			continue
+		}
+		for block, received := range pp.received {
+			if received || requestedFrom(pp.requested[block], pc) {
+				continue
+			}
+			if best == nil || len(pp.requested[block]) < len(best.requested[bestBlock]) {
+				best, bestBlock = pp, block
+			}
+		}
+	}
+	return best, bestBlock
+}
+
+// inflightFor returns the number of blocks requested from a peer that
+// haven't arrived yet
+func (p *picker) inflightFor(pc *peerConn) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inflight[pc]
+}
+
+// receive stores a block that arrived from a peer, and sends a Cancel for
+// it to the other peers it was requested from. Returns the piece if this
+// was its last block, in which case it must be passed to complete or fail
+// once verified.
+func (p *picker) receive(pc *peerConn, index, begin int, block []byte) (*pieceProgress, error) {
+	p.mu.Lock()
+	pp := p.progress[index]
+	if pp == nil {
+		p.mu.Unlock()
+		return nil, nil // a late block of a piece we no longer need
+	}
+	b := begin / MaxBlockSize
+	if begin%MaxBlockSize != 0 || b >= len(pp.received) {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("Unexpected block at offset %d of piece #%d", begin, index)
+	}
+	if _, length := pp.blockBounds(b); len(block) != length {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("Block at offset %d of piece #%d has length %d, expected %d", begin, index, len(block), length)
+	}
+	if pp.received[b] {
+		p.mu.Unlock()
+		return nil, nil // another peer was faster
+	}
+
+	copy(pp.buf[begin:], block)
+	pp.received[b] = true
+	pp.left--
+	var others []*peerConn
+	releaseInflight(len(pp.requested[b]))
+	for _, other := range pp.requested[b] {
+		p.inflight[other]--
+		p.totalInflight--
+		if other != pc {
+			others = append(others, other)
+		}
+	}
+	pp.requested[b] = nil
+	finished := pp.left == 0
+	p.mu.Unlock()
+
+	for _, other := range others {
+		other.c.SendCancel(index, begin, len(block))
+	}
+	if finished {
+		return pp, nil
+	}
+	return nil, nil
+}
+
+// release forgets the blocks requested from a peer, after it choked us and
+// discarded them or disconnected. The blocks already received are kept.
+func (p *picker) release(pc *peerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pp := range p.progress {
+		for block, peers := range pp.requested {
+			for i, other := range peers {
+				if other == pc {
+					pp.requested[block] = append(peers[:i], peers[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	p.totalInflight -= p.inflight[pc]
+	releaseInflight(p.inflight[pc])
+	delete(p.inflight, pc)
+}
+
+// fail drops the data of a piece that failed its integrity check, so that
+// it is downloaded again
+func (p *picker) fail(pp *pieceProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for block := range pp.received {
+		pp.received[block] = false
+	}
+	pp.left = len(pp.received)
+}
+
+// complete marks a piece as verified and written to storage
+func (p *picker) complete(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] == pieceDone {
+		return
+	}
+	if p.state[index] == pieceWanted {
+		p.wanted--
+	}
+	delete(p.progress, index)
+	p.state[index] = pieceDone
+	p.done++
+}
+
+// finished tells if every piece is done
+func (p *picker) finished() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done == len(p.state)
+}
+
+func (pp *pieceProgress) blockBounds(block int) (begin, length int) {
+	begin = block * MaxBlockSize
+	length = MaxBlockSize
+	if begin+length > len(pp.buf) {
+		length = len(pp.buf) - begin
+	}
+	return begin, length
+}
+
+// unrequestedBlock returns the first block neither received nor requested
+// from any peer, or -1
+func (pp *pieceProgress) unrequestedBlock() int {
+	for block, received := range pp.received {
+		if !received && len(pp.requested[block]) == 0 {
+			return block
+		}
+	}
+	return -1
+}
+
+func (pp *pieceProgress) unrequestedBlocks() int {
+	n := 0
+	for block, received := range pp.received {
+		if !received && len(pp.requested[block]) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func requestedFrom(peers []*peerConn, pc *peerConn) bool {
+	for _, other := range peers {
+		if other == pc {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,367 @@
+package p2p
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/bitfield"
+	"github.com/cedrickchee/min-torrent/client"
+	"github.com/cedrickchee/min-torrent/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakePeer returns a peerConn whose messages are sent over a pipe, and
+// a channel receiving what the remote end reads from it. Closing
+// pc.c.Conn releases both.
+func newFakePeer() (*peerConn, <-chan *message.Message) {
+	local, remote := net.Pipe()
+	msgs := make(chan *message.Message, 16)
+	go func() {
+		for {
+			msg, err := message.Read(remote)
+			if err != nil {
+				remote.Close()
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	return &peerConn{c: &client.Client{Conn: local}}, msgs
+}
+
+// newTestPicker returns a picker over numPieces pieces of pieceLength
+// bytes, none of which we have
+func newTestPicker(numPieces, pieceLength int) *picker {
+	return newPicker(numPieces, func(int) int { return pieceLength }, bitfield.New(numPieces))
+}
+
+// allPieces returns a bitfield with every one of numPieces pieces
+func allPieces(numPieces int) bitfield.Bitfield {
+	bf := bitfield.New(numPieces)
+	for index := 0; index < numPieces; index++ {
+		bf.SetPiece(index)
+	}
+	return bf
+}
+
+type testRequest struct {
+	index, begin, length int
+}
+
+func nextTestRequest(p *picker, pc *peerConn, bf bitfield.Bitfield) (testRequest, bool) {
+	index, begin, length, ok := p.nextRequest(pc, bf)
+	return testRequest{index, begin, length}, ok
+}
+
+func TestPickerSplitsPieceBetweenPeers(t *testing.T) {
+	p := newTestPicker(1, 2*MaxBlockSize+100)
+	a, _ := newFakePeer()
+	defer a.c.Conn.Close()
+	b, _ := newFakePeer()
+	defer b.c.Conn.Close()
+	bf := allPieces(1)
+
+	req, ok := nextTestRequest(p, a, bf)
+	require.True(t, ok)
+	assert.Equal(t, testRequest{0, 0, MaxBlockSize}, req)
+	req, ok = nextTestRequest(p, b, bf)
+	require.True(t, ok)
+	assert.Equal(t, testRequest{0, MaxBlockSize, MaxBlockSize}, req)
+	req, ok = nextTestRequest(p, a, bf)
+	require.True(t, ok)
+	assert.Equal(t, testRequest{0, 2 * MaxBlockSize, 100}, req)
+
+	assert.Equal(t, 2, p.inflightFor(a))
+	assert.Equal(t, 1, p.inflightFor(b))
+	assert.Equal(t, 3, p.totalInflight)
+}
+
+func TestPickerReceive(t *testing.T) {
+	p := newTestPicker(1, 2*MaxBlockSize+100)
+	a, _ := newFakePeer()
+	defer a.c.Conn.Close()
+	bf := allPieces(1)
+	data := make([]byte, 2*MaxBlockSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	var reqs []testRequest
+	for {
+		req, ok := nextTestRequest(p, a, bf)
+		if !ok {
+			break
+		}
+		reqs = append(reqs, req)
+	}
+	require.Len(t, reqs, 3)
+
+	// Blocks may arrive in any order; the piece is done with the last one
+	for i, block := range []int{2, 0, 1} {
+		req := reqs[block]
+		pp, err := p.receive(a, req.index, req.begin, data[req.begin:req.begin+req.length])
+		require.Nil(t, err)
+		if i < 2 {
+			assert.Nil(t, pp)
+			continue
+		}
+		require.NotNil(t, pp)
+		assert.Equal(t, 0, pp.index)
+		assert.True(t, bytes.Equal(data, pp.buf))
+	}
+	assert.Equal(t, 0, p.inflightFor(a))
+	assert.Equal(t, 0, p.totalInflight)
+
+	p.complete(0)
+	assert.True(t, p.finished())
+}
+
+func TestPickerReceiveInvalidBlock(t *testing.T) {
+	tests := map[string]struct {
+		index, begin, length int
+		fails                bool
+	}{
+		"unaligned offset": {
+			index:  0,
+			begin:  100,
+			length: MaxBlockSize,
+			fails:  true,
+		},
+		"offset past the piece": {
+			index:  0,
+			begin:  2 * MaxBlockSize,
+			length: MaxBlockSize,
+			fails:  true,
+		},
+		"wrong length": {
+			index:  0,
+			begin:  MaxBlockSize,
+			length: 100,
+			fails:  true,
+		},
+		"piece not in progress": {
+			index:  1,
+			begin:  0,
+			length: MaxBlockSize,
+			fails:  false,
+		},
+	}
+
+	for name, test := range tests {
+		p := newTestPicker(2, 2*MaxBlockSize)
+		a, _ := newFakePeer()
+		_, ok := nextTestRequest(p, a, allPieces(1))
+		require.True(t, ok, name)
+
+		pp, err := p.receive(a, test.index, test.begin, make([]byte, test.length))
+		assert.Nil(t, pp, name)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, 1, p.inflightFor(a), name)
+		a.c.Conn.Close()
+	}
+}
+
+func TestPickerReleaseKeepsBlocks(t *testing.T) {
+	p := newTestPicker(1, 3*MaxBlockSize)
+	a, _ := newFakePeer()
+	defer a.c.Conn.Close()
+	b, _ := newFakePeer()
+	defer b.c.Conn.Close()
+	bf := allPieces(1)
+
+	first, _ := nextTestRequest(p, a, bf)
+	nextTestRequest(p, a, bf)
+	_, err := p.receive(a, first.index, first.begin, make([]byte, first.length))
+	require.Nil(t, err)
+
+	// a drops with its second block outstanding
+	p.release(a)
+	assert.Equal(t, 0, p.inflightFor(a))
+	assert.Equal(t, 0, p.totalInflight)
+
+	// b is only asked for the blocks that didn't arrive
+	var begins []int
+	for {
+		req, ok := nextTestRequest(p, b, bf)
+		if !ok {
+			break
+		}
+		begins = append(begins, req.begin)
+	}
+	assert.Equal(t, []int{MaxBlockSize, 2 * MaxBlockSize}, begins)
+	assert.True(t, p.progress[0].received[0])
+}
+
+func TestPickerFail(t *testing.T) {
+	p := newTestPicker(1, 2*MaxBlockSize)
+	a, _ := newFakePeer()
+	defer a.c.Conn.Close()
+	bf := allPieces(1)
+
+	var pp *pieceProgress
+	for {
+		req, ok := nextTestRequest(p, a, bf)
+		if !ok {
+			break
+		}
+		var err error
+		pp, err = p.receive(a, req.index, req.begin, make([]byte, req.length))
+		require.Nil(t, err)
+	}
+	require.NotNil(t, pp)
+
+	// A piece that fails its hash check is downloaded again in full
+	p.fail(pp)
+	var reqs []testRequest
+	for {
+		req, ok := nextTestRequest(p, a, bf)
+		if !ok {
+			break
+		}
+		reqs = append(reqs, req)
+	}
+	assert.Equal(t, []testRequest{{0, 0, MaxBlockSize}, {0, MaxBlockSize, MaxBlockSize}}, reqs)
+	assert.False(t, p.finished())
+}
+
+func TestPickerEndgame(t *testing.T) {
+	p := newTestPicker(1, 2*MaxBlockSize)
+	a, aMsgs := newFakePeer()
+	defer a.c.Conn.Close()
+	b, bMsgs := newFakePeer()
+	defer b.c.Conn.Close()
+	bf := allPieces(1)
+
+	// Endgame doesn't start while a block is left to request
+	_, ok := nextTestRequest(p, a, bf)
+	require.True(t, ok)
+	assert.False(t, p.endgame)
+	_, ok = nextTestRequest(p, a, bf)
+	require.True(t, ok)
+	assert.False(t, p.endgame)
+
+	// Every block is requested: outstanding blocks aren't asked for twice
+	// from the same peer, but are from another one
+	_, ok = nextTestRequest(p, a, bf)
+	assert.False(t, ok)
+	assert.True(t, p.endgame)
+	var reqs []testRequest
+	for {
+		req, ok := nextTestRequest(p, b, bf)
+		if !ok {
+			break
+		}
+		reqs = append(reqs, req)
+	}
+	assert.ElementsMatch(t, []testRequest{{0, 0, MaxBlockSize}, {0, MaxBlockSize, MaxBlockSize}}, reqs)
+	assert.Equal(t, 2, p.inflightFor(a))
+	assert.Equal(t, 2, p.inflightFor(b))
+	assert.Equal(t, 4, p.totalInflight)
+
+	// The first copy of a block to arrive cancels it with the other peer
+	pp, err := p.receive(b, 0, 0, make([]byte, MaxBlockSize))
+	require.Nil(t, err)
+	assert.Nil(t, pp)
+	assert.Equal(t, 1, p.inflightFor(a))
+	assert.Equal(t, 1, p.inflightFor(b))
+	assert.Equal(t, 2, p.totalInflight)
+	select {
+	case msg := <-aMsgs:
+		assert.Equal(t, message.FormatCancel(0, 0, MaxBlockSize), msg)
+	case <-time.After(time.Second):
+		t.Error("No Cancel was sent")
+	}
+	select {
+	case msg := <-bMsgs:
+		t.Errorf("Unexpected message %s to the peer that sent the block", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A late copy is ignored
+	pp, err = p.receive(a, 0, 0, make([]byte, MaxBlockSize))
+	require.Nil(t, err)
+	assert.Nil(t, pp)
+	assert.Equal(t, 2, p.totalInflight)
+}
+
+func TestPickerRarestFirst(t *testing.T) {
+	tests := map[string]struct {
+		have         []int // pieces we have
+		availability []int
+		peer         []int // pieces the peer has
+		chosen       []int // pieces that may be chosen first
+	}{
+		"rarest piece": {
+			have:         []int{0, 1, 2, 3},
+			availability: []int{5, 5, 5, 5, 3, 1, 2, 1},
+			peer:         []int{4, 5, 6},
+			chosen:       []int{5},
+		},
+		"ties broken at random": {
+			have:         []int{0, 1, 2, 3},
+			availability: []int{5, 5, 5, 5, 1, 1, 2, 1},
+			peer:         []int{4, 5, 6},
+			chosen:       []int{4, 5},
+		},
+		"random before the first pieces": {
+			have:         []int{0, 1, 2},
+			availability: []int{5, 5, 5, 5, 3, 1, 2, 1},
+			peer:         []int{3, 4, 5, 6},
+			chosen:       []int{3, 4, 5, 6},
+		},
+	}
+
+	for name, test := range tests {
+		have := bitfield.New(len(test.availability))
+		for _, index := range test.have {
+			have.SetPiece(index)
+		}
+		bf := bitfield.New(len(test.availability))
+		for _, index := range test.peer {
+			bf.SetPiece(index)
+		}
+
+		chosen := make(map[int]bool)
+		for seed := int64(0); seed < 50; seed++ {
+			p := newPicker(len(test.availability), func(int) int { return MaxBlockSize }, have)
+			p.rng = rand.New(rand.NewSource(seed))
+			copy(p.availability, test.availability)
+			a, _ := newFakePeer()
+			index, _, _, ok := p.nextRequest(a, bf)
+			a.c.Conn.Close()
+			require.True(t, ok, name)
+			chosen[index] = true
+		}
+		var indexes []int
+		for index := range chosen {
+			indexes = append(indexes, index)
+		}
+		assert.ElementsMatch(t, test.chosen, indexes, name)
+	}
+}
+
+func TestPickerAvailability(t *testing.T) {
+	p := newTestPicker(10, MaxBlockSize)
+	a := bitfield.Bitfield{0b11000000, 0b01000000}
+	b := bitfield.Bitfield{0b10000000, 0b11111111} // spare bits are ignored
+
+	p.addPeer(a)
+	p.addPeer(b)
+	assert.Equal(t, []int{2, 1, 0, 0, 0, 0, 0, 0, 1, 2}, p.availability)
+
+	p.addPiece(2)
+	p.addPiece(10) // out of range
+	p.addPiece(-1)
+	assert.Equal(t, []int{2, 1, 1, 0, 0, 0, 0, 0, 1, 2}, p.availability)
+
+	p.removePeer(a)
+	assert.Equal(t, []int{1, 0, 1, 0, 0, 0, 0, 0, 1, 1}, p.availability)
+}
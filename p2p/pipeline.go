@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Bounds of the number of requests kept pending with a peer
+const (
+	initialBacklog = 5   // before the connection is measured
+	minBacklog     = 2   // so that the peer is never left waiting for a request
+	maxBacklog     = 250 // for peers that don't tell how many they queue
+)
+
+// maxInflight bounds the bytes of all blocks requested from peers that
+// haven't arrived yet, across every torrent
+const maxInflight = 16 * 1024 * 1024
+
+// inflightBlocks counts the blocks requested by every torrent's picker
+// that haven't arrived yet, updated atomically
+var inflightBlocks int64
+
+// rateInterval is how long download rates are measured over
+const rateInterval = time.Second
+
+// probeTimeout is how long a timed request may take before another one is
+// timed instead, as it may have been cancelled
+const probeTimeout = 30 * time.Second
+
+// pipeline sizes the queue of requests kept pending with a peer. To keep
+// the connection busy, there should be enough requests in flight to
+// cover a round trip at the rate the peer sends blocks: the
+// bandwidth-delay product. The queue is twice that, so that it grows
+// quickly while the rate is limited by the queue itself.
+//
+// A pipeline is guarded by the dlMu of its peerConn.
+type pipeline struct {
+	limit int // requests the peer queues, from its reqq
+
+	rate        float64 // bytes per second, smoothed
+	windowStart time.Time
+	windowBytes int
+
+	minRTT    time.Duration // shortest time a block took to arrive
+	probe     blockRequest  // request being timed
+	probeSent time.Time     // zero if no request is being timed
+}
+
+func newPipeline() *pipeline {
+	return &pipeline{limit: maxBacklog}
+}
+
+// setLimit records the number of requests the peer said it queues
+func (pl *pipeline) setLimit(reqq int) {
+	if reqq <= 0 || reqq > maxBacklog {
+		reqq = maxBacklog
+	}
+	pl.limit = reqq
+}
+
+// size returns the number of requests to keep pending
+func (pl *pipeline) size() int {
+	if pl.rate == 0 || pl.minRTT == 0 {
+		return min(initialBacklog, pl.limit)
+	}
+	bdp := pl.rate * pl.minRTT.Seconds() / MaxBlockSize
+	size := int(2*bdp) + 1
+	if size < minBacklog {
+		size = minBacklog
+	}
+	return min(size, pl.limit)
+}
+
+// requested is called when a request is sent
+func (pl *pipeline) requested(req blockRequest, now time.Time) {
+	if pl.probeSent.IsZero() || now.Sub(pl.probeSent) > probeTimeout {
+		pl.probe = req
+		pl.probeSent = now
+	}
+}
+
+// received is called when a block arrives
+func (pl *pipeline) received(req blockRequest, now time.Time) {
+	if !pl.probeSent.IsZero() && req == pl.probe {
+		rtt := now.Sub(pl.probeSent)
+		if pl.minRTT == 0 || rtt < pl.minRTT {
+			pl.minRTT = rtt
+		}
+		pl.probeSent = time.Time{}
+	}
+
+	if pl.windowStart.IsZero() {
+		pl.windowStart = now
+	}
+	pl.windowBytes += req.length
+	elapsed := now.Sub(pl.windowStart)
+	if elapsed >= rateInterval {
+		rate := float64(pl.windowBytes) / elapsed.Seconds()
+		if pl.rate == 0 {
+			pl.rate = rate
+		} else {
+			pl.rate = 0.7*pl.rate + 0.3*rate
+		}
+		pl.windowStart = now
+		pl.windowBytes = 0
+	}
+}
+
+// reset forgets the requests in flight, after the peer discarded them or
+// when there are none, so that idle time doesn't count against the rate
+func (pl *pipeline) reset() {
+	pl.probeSent = time.Time{}
+	pl.windowStart = time.Time{}
+	pl.windowBytes = 0
+}
+
+// reserveInflight takes a block out of the budget shared by every torrent.
+// Returns false if it is used up.
+func reserveInflight() bool {
+	if atomic.AddInt64(&inflightBlocks, 1)*MaxBlockSize > maxInflight {
+		atomic.AddInt64(&inflightBlocks, -1)
+		return false
+	}
+	return true
+}
+
+// releaseInflight gives blocks back to the shared budget
+func releaseInflight(blocks int) {
+	atomic.AddInt64(&inflightBlocks, -int64(blocks))
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,147 @@
+package p2p
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineSize(t *testing.T) {
+	tests := map[string]struct {
+		rate   float64
+		minRTT time.Duration
+		limit  int
+		output int
+	}{
+		"initial backlog before a rate is measured": {
+			rate:   0,
+			minRTT: 100 * time.Millisecond,
+			limit:  maxBacklog,
+			output: initialBacklog,
+		},
+		"initial backlog before a round trip is measured": {
+			rate:   10 * MaxBlockSize,
+			minRTT: 0,
+			limit:  maxBacklog,
+			output: initialBacklog,
+		},
+		"initial backlog within the peer's limit": {
+			rate:   0,
+			minRTT: 0,
+			limit:  3,
+			output: 3,
+		},
+		"twice the bandwidth-delay product": {
+			rate:   10 * MaxBlockSize,
+			minRTT: time.Second,
+			limit:  maxBacklog,
+			output: 21,
+		},
+		"clamped to minBacklog": {
+			rate:   1000,
+			minRTT: 10 * time.Millisecond,
+			limit:  maxBacklog,
+			output: minBacklog,
+		},
+		"clamped to the peer's limit": {
+			rate:   1000 * MaxBlockSize,
+			minRTT: time.Second,
+			limit:  50,
+			output: 50,
+		},
+		"clamped to maxBacklog": {
+			rate:   1000 * MaxBlockSize,
+			minRTT: time.Second,
+			limit:  maxBacklog,
+			output: maxBacklog,
+		},
+	}
+
+	for name, test := range tests {
+		pl := &pipeline{limit: test.limit, rate: test.rate, minRTT: test.minRTT}
+		assert.Equal(t, test.output, pl.size(), name)
+	}
+}
+
+func TestPipelineSetLimit(t *testing.T) {
+	tests := map[string]struct {
+		reqq   int
+		output int
+	}{
+		"reqq": {
+			reqq:   100,
+			output: 100,
+		},
+		"largest reqq": {
+			reqq:   maxBacklog,
+			output: maxBacklog,
+		},
+		"zero": {
+			reqq:   0,
+			output: maxBacklog,
+		},
+		"negative": {
+			reqq:   -1,
+			output: maxBacklog,
+		},
+		"too large": {
+			reqq:   300,
+			output: maxBacklog,
+		},
+	}
+
+	for name, test := range tests {
+		pl := newPipeline()
+		pl.setLimit(test.reqq)
+		assert.Equal(t, test.output, pl.limit, name)
+	}
+}
+
+func TestPipelineReceived(t *testing.T) {
+	pl := newPipeline()
+	start := time.Unix(1000, 0)
+	first := blockRequest{0, 0, MaxBlockSize}
+	second := blockRequest{0, MaxBlockSize, MaxBlockSize}
+	third := blockRequest{0, 2 * MaxBlockSize, MaxBlockSize}
+
+	// Only the first of the requests in flight is timed
+	pl.requested(first, start)
+	pl.requested(second, start.Add(10*time.Millisecond))
+	pl.received(first, start.Add(100*time.Millisecond))
+	assert.Equal(t, 100*time.Millisecond, pl.minRTT)
+	assert.Equal(t, 0.0, pl.rate)
+
+	// The rate is measured once rateInterval has passed
+	pl.received(second, start.Add(1100*time.Millisecond))
+	assert.Equal(t, 100*time.Millisecond, pl.minRTT)
+	assert.Equal(t, float64(2*MaxBlockSize), pl.rate)
+
+	// Later measures are smoothed, and a slower round trip is ignored
+	pl.requested(third, start.Add(1100*time.Millisecond))
+	pl.received(third, start.Add(2100*time.Millisecond))
+	assert.Equal(t, 100*time.Millisecond, pl.minRTT)
+	assert.InDelta(t, 0.7*2*MaxBlockSize+0.3*MaxBlockSize, pl.rate, 0.001)
+}
+
+func TestMaxInflightIsShared(t *testing.T) {
+	defer func(blocks int64) { atomic.StoreInt64(&inflightBlocks, blocks) }(atomic.LoadInt64(&inflightBlocks))
+	atomic.StoreInt64(&inflightBlocks, maxInflight/MaxBlockSize-1)
+	first := newTestPicker(1, MaxBlockSize)
+	second := newTestPicker(1, MaxBlockSize)
+	a, _ := newFakePeer()
+	defer a.c.Conn.Close()
+	bf := allPieces(1)
+
+	// The last block of the budget goes to the first torrent
+	_, ok := nextTestRequest(first, a, bf)
+	assert.True(t, ok)
+	_, ok = nextTestRequest(second, a, bf)
+	assert.False(t, ok)
+
+	// and is available to the other once it is released
+	first.release(a)
+	_, ok = nextTestRequest(second, a, bf)
+	assert.True(t, ok)
+}
@@ -0,0 +1,356 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/handshake"
+	"github.com/cedrickchee/min-torrent/listener"
+	"github.com/cedrickchee/min-torrent/message"
+	"github.com/cedrickchee/min-torrent/peers"
+	"github.com/cedrickchee/min-torrent/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testContent is the content of a torrent along with its layout
+type testContent struct {
+	data        []byte
+	pieceLength int
+	hashes      [][20]byte
+	info        *storage.Info
+}
+
+func newTestContent(infoHash [20]byte, length, pieceLength int) *testContent {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(int64(length))).Read(data)
+	var hashes [][20]byte
+	for begin := 0; begin < length; begin += pieceLength {
+		end := begin + pieceLength
+		if end > length {
+			end = length
+		}
+		hashes = append(hashes, sha1.Sum(data[begin:end]))
+	}
+	return &testContent{
+		data:        data,
+		pieceLength: pieceLength,
+		hashes:      hashes,
+		info: &storage.Info{
+			InfoHash:    infoHash,
+			PieceLength: pieceLength,
+			Length:      int64(length),
+			Files:       []storage.FileInfo{{Length: int64(length)}},
+		},
+	}
+}
+
+// piece returns the data of a piece
+func (tc *testContent) piece(index int) []byte {
+	begin := index * tc.pieceLength
+	end := begin + tc.pieceLength
+	if end > len(tc.data) {
+		end = len(tc.data)
+	}
+	return tc.data[begin:end]
+}
+
+// newTestTorrent returns a torrent over memory storage holding the given
+// pieces of tc
+func newTestTorrent(tc *testContent, peerID [20]byte, pieces []int) (*Torrent, error) {
+	st, err := storage.NewMemory().OpenTorrent(tc.info)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range pieces {
+		_, err = st.Piece(index).WriteAt(tc.piece(index), 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Torrent{
+		PeerID:      peerID,
+		InfoHash:    tc.info.InfoHash,
+		PieceHashes: tc.hashes,
+		PieceLength: tc.pieceLength,
+		Length:      len(tc.data),
+		Storage:     st,
+	}, nil
+}
+
+// allIndexes returns the indexes of numPieces pieces
+func allIndexes(numPieces int) []int {
+	indexes := make([]int, numPieces)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
+
+// startSeeder seeds tc to the peers connecting to the returned listener
+func startSeeder(tc *testContent, peerID [20]byte) (*Torrent, *listener.Listener, error) {
+	seeder, err := newTestTorrent(tc, peerID, allIndexes(len(tc.hashes)))
+	if err != nil {
+		return nil, nil, err
+	}
+	err = seeder.Seed()
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := listener.Listen(0)
+	if err != nil {
+		seeder.Close()
+		return nil, nil, err
+	}
+	go l.Serve()
+	l.Add(tc.info.InfoHash, seeder)
+	return seeder, l, nil
+}
+
+func localPeer(addr net.Addr) peers.Peer {
+	return peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: uint16(addr.(*net.TCPAddr).Port)}
+}
+
+// assertContent checks that every piece in the torrent's storage matches tc
+func assertContent(t *testing.T, tc *testContent, tr *Torrent, msgAndArgs ...interface{}) {
+	for index := range tc.hashes {
+		buf := make([]byte, len(tc.piece(index)))
+		_, err := tr.Storage.Piece(index).ReadAt(buf, 0)
+		require.Nil(t, err, msgAndArgs...)
+		if !bytes.Equal(tc.piece(index), buf) {
+			assert.Fail(t, "Piece differs", msgAndArgs...)
+			return
+		}
+	}
+}
+
+// downloadWithin runs Download, failing the test if it takes longer than
+// timeout
+func downloadWithin(t *testing.T, tr *Torrent, timeout time.Duration, msgAndArgs ...interface{}) {
+	done := make(chan error, 1)
+	go func() { done <- tr.Download() }()
+	select {
+	case err := <-done:
+		require.Nil(t, err, msgAndArgs...)
+	case <-time.After(timeout):
+		tr.Close()
+		require.FailNow(t, "Download timed out", msgAndArgs...)
+	}
+}
+
+func TestDownloadFromSeeder(t *testing.T) {
+	tc := newTestContent([20]byte{1}, 1000000, 32*1024)
+	seeder, l, err := startSeeder(tc, [20]byte{1})
+	require.Nil(t, err)
+	defer seeder.Close()
+	defer l.Close()
+
+	leecher, err := newTestTorrent(tc, [20]byte{2}, nil)
+	require.Nil(t, err)
+	leecher.Peers = []peers.Peer{localPeer(l.Addr())}
+	downloadWithin(t, leecher, 30*time.Second)
+	leecher.Close()
+
+	assertContent(t, tc, leecher)
+	assert.Equal(t, int64(len(tc.data)), leecher.Stats().Downloaded)
+	assert.Equal(t, int64(0), leecher.Stats().Left)
+	assert.Equal(t, int64(len(tc.data)), seeder.Stats().Uploaded)
+}
+
+func TestDownloadFromSeveralSeeders(t *testing.T) {
+	tc := newTestContent([20]byte{2}, 2000000, 32*1024)
+	var swarm []peers.Peer
+	for i := 0; i < 3; i++ {
+		seeder, l, err := startSeeder(tc, [20]byte{1, byte(i)})
+		require.Nil(t, err)
+		defer seeder.Close()
+		defer l.Close()
+		swarm = append(swarm, localPeer(l.Addr()))
+	}
+
+	// The first half is already in storage and isn't downloaded again
+	half := allIndexes(len(tc.hashes) / 2)
+	leecher, err := newTestTorrent(tc, [20]byte{2}, half)
+	require.Nil(t, err)
+	leecher.Have = make([]byte, (len(tc.hashes)+7)/8)
+	for _, index := range half {
+		leecher.Have[index/8] |= 1 << uint(7-index%8)
+	}
+	leecher.Peers = swarm
+	downloadWithin(t, leecher, 30*time.Second)
+	leecher.Close()
+
+	assertContent(t, tc, leecher)
+	assert.Equal(t, int64(len(tc.data)-len(half)*tc.pieceLength), leecher.Stats().Downloaded)
+}
+
+// scriptedPeer accepts a connection on ln and plays a peer that has every
+// piece. Once handshaked, it sends announce, then answers requests with
+// the blocks of tc if serve is set. requested, if set, is signalled when a
+// request arrives, and cancels receives the Cancels that do.
+type scriptedPeer struct {
+	ln        net.Listener
+	tc        *testContent
+	announce  []*message.Message
+	serve     bool
+	requested chan struct{}
+	cancels   chan blockRequest
+}
+
+func (f *scriptedPeer) run() {
+	conn, err := f.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, err = handshake.Read(conn)
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(handshake.New(f.tc.info.InfoHash, [20]byte{9}).Serialize())
+	if err != nil {
+		return
+	}
+	for _, msg := range f.announce {
+		_, err = conn.Write(msg.Serialize())
+		if err != nil {
+			return
+		}
+	}
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgRequest:
+			if f.requested != nil {
+				select {
+				case f.requested <- struct{}{}:
+				default:
+				}
+			}
+			if !f.serve {
+				continue
+			}
+			index, begin, length, err := message.ParseRequest(msg)
+			if err != nil {
+				return
+			}
+			block := f.tc.piece(index)[begin : begin+length]
+			_, err = conn.Write(message.FormatPiece(index, begin, block).Serialize())
+			if err != nil {
+				return
+			}
+		case message.MsgCancel:
+			index, begin, length, err := message.ParseRequest(msg)
+			if err == nil && f.cancels != nil {
+				select {
+				case f.cancels <- blockRequest{index, begin, length}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// fullBitfield returns a Bitfield message with every piece of tc, and
+// extra spare bytes
+func fullBitfield(tc *testContent, extra int) *message.Message {
+	payload := make([]byte, (len(tc.hashes)+7)/8+extra)
+	for i := range payload {
+		payload[i] = 0xff
+	}
+	return &message.Message{ID: message.MsgBitfield, Payload: payload}
+}
+
+func TestDownloadEndgame(t *testing.T) {
+	tc := newTestContent([20]byte{3}, 300000, 32*1024)
+	seeder, l, err := startSeeder(tc, [20]byte{1})
+	require.Nil(t, err)
+	defer seeder.Close()
+	defer l.Close()
+
+	// A peer that unchokes us but never sends the blocks it is asked for.
+	// Without endgame, its blocks would only be requested elsewhere once
+	// it is dropped as snubbed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	stuck := &scriptedPeer{
+		ln:        ln,
+		tc:        tc,
+		announce:  []*message.Message{fullBitfield(tc, 0), {ID: message.MsgUnchoke}},
+		serve:     false,
+		requested: make(chan struct{}, 1),
+		cancels:   make(chan blockRequest, 100),
+	}
+	go stuck.run()
+
+	leecher, err := newTestTorrent(tc, [20]byte{2}, nil)
+	require.Nil(t, err)
+	leecher.Peers = []peers.Peer{localPeer(ln.Addr())}
+	done := make(chan error, 1)
+	go func() { done <- leecher.Download() }()
+	defer leecher.Close()
+
+	// The seeder only joins once blocks are pending with the stuck peer
+	select {
+	case <-stuck.requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stuck peer was sent no request")
+	}
+	leecher.AddPeers([]peers.Peer{localPeer(l.Addr())})
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(snubTimeout / 2):
+		t.Fatal("Download timed out")
+	}
+
+	assertContent(t, tc, leecher)
+	select {
+	case <-stuck.cancels:
+	case <-time.After(time.Second):
+		t.Error("Stuck peer was sent no Cancel")
+	}
+}
+
+func TestDownloadPieceAnnouncements(t *testing.T) {
+	tc := newTestContent([20]byte{4}, 500000, 32*1024)
+	haves := make([]*message.Message, len(tc.hashes))
+	for index := range haves {
+		haves[index] = message.FormatHave(index)
+	}
+	unchoke := &message.Message{ID: message.MsgUnchoke}
+
+	tests := map[string][]*message.Message{
+		"bitfield":                       {fullBitfield(tc, 0), unchoke},
+		"HaveAll":                        {{ID: message.MsgHaveAll}, unchoke},
+		"HaveNone, then Haves":           append([]*message.Message{{ID: message.MsgHaveNone}, unchoke}, haves...),
+		"no bitfield, only Haves":        append(haves, unchoke),
+		"late bitfield with spare bytes": {unchoke, fullBitfield(tc, 3)},
+	}
+
+	for name, announce := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err, name)
+		peer := &scriptedPeer{ln: ln, tc: tc, announce: announce, serve: true}
+		go peer.run()
+
+		leecher, err := newTestTorrent(tc, [20]byte{2}, nil)
+		require.Nil(t, err, name)
+		leecher.Peers = []peers.Peer{localPeer(ln.Addr())}
+		downloadWithin(t, leecher, 30*time.Second, name)
+		leecher.Close()
+		ln.Close()
+		assertContent(t, tc, leecher, name)
+	}
+}
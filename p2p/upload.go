@@ -0,0 +1,180 @@
+package p2p
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cedrickchee/min-torrent/client"
+)
+
+// maxUploadQueue bounds how many requests a peer may have waiting on us.
+// Requests beyond it are dropped; the peer will ask again.
+const maxUploadQueue = 256
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// uploader answers a peer's block requests. Requests wait in a queue until
+// they are sent, so the peer can still cancel them.
+type uploader struct {
+	t *Torrent
+	c *client.Client
+
+	mu      sync.Mutex
+	queue   []blockRequest
+	pending chan struct{} // signalled when a request is queued
+	done    chan struct{}
+	stopped chan struct{} // closed when run returns
+
+	uploaded int64 // bytes sent to this peer, updated atomically
+}
+
+func newUploader(t *Torrent, c *client.Client) *uploader {
+	return &uploader{
+		t:       t,
+		c:       c,
+		pending: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// request queues a block the peer asked for. Returns an error if the
+// request is invalid, in which case the peer should be dropped.
+func (u *uploader) request(req blockRequest) error {
+	err := u.t.checkRequest(req)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.queue) >= maxUploadQueue {
+		return nil
+	}
+	for _, queued := range u.queue {
+		if queued == req {
+			return nil
+		}
+	}
+	u.queue = append(u.queue, req)
+	select {
+	case u.pending <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// cancel removes a block from the queue if it hasn't been sent yet
+func (u *uploader) cancel(req blockRequest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i, queued := range u.queue {
+		if queued == req {
+			u.queue = append(u.queue[:i], u.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// clear discards every queued request
+func (u *uploader) clear() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.queue = nil
+}
+
+// run sends queued blocks until stopped or the connection fails
+func (u *uploader) run() {
+	defer close(u.stopped)
+	for {
+		select {
+		case <-u.pending:
+		case <-u.done:
+			return
+		}
+
+		for {
+			select {
+			case <-u.done:
+				return
+			default:
+			}
+			req, ok := u.next()
+			if !ok {
+				break
+			}
+			block, err := u.t.readBlock(req)
+			if err != nil {
+				log.Printf("Could not read block of piece #%d: %v\n", req.index, err)
+				continue
+			}
+			err = u.c.SendPiece(req.index, req.begin, block)
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&u.uploaded, int64(len(block)))
+			atomic.AddInt64(&u.t.uploaded, int64(len(block)))
+		}
+	}
+}
+
+// next pops the oldest queued request
+func (u *uploader) next() (blockRequest, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.queue) == 0 {
+		return blockRequest{}, false
+	}
+	req := u.queue[0]
+	u.queue = u.queue[1:]
+	return req, true
+}
+
+// stop makes run return and waits for it. The connection must be closed
+// first if run may be waiting to send a block.
+func (u *uploader) stop() {
+	close(u.done)
+	<-u.stopped
+}
+
+// checkRequest validates a peer's request against the pieces we have
+func (t *Torrent) checkRequest(req blockRequest) error {
+	if req.index < 0 || req.index >= len(t.PieceHashes) {
+		return fmt.Errorf("Request for piece #%d out of range", req.index)
+	}
+	if req.length <= 0 || req.length > MaxBlockSize {
+		return fmt.Errorf("Request length %d out of range", req.length)
+	}
+	if req.begin < 0 || req.begin+req.length > t.calculatePieceSize(req.index) {
+		return fmt.Errorf("Request [%d:%d] out of bounds for piece #%d", req.begin, req.begin+req.length, req.index)
+	}
+	t.mu.Lock()
+	has := t.have.HasPiece(req.index)
+	t.mu.Unlock()
+	if !has {
+		return fmt.Errorf("Request for piece #%d which we don't have", req.index)
+	}
+	return nil
+}
+
+// readBlock returns the data of a block of a verified piece
+func (t *Torrent) readBlock(req blockRequest) ([]byte, error) {
+	t.mu.Lock()
+	has := t.have.HasPiece(req.index)
+	t.mu.Unlock()
+	if !has {
+		return nil, fmt.Errorf("Piece #%d is not available", req.index)
+	}
+	block := make([]byte, req.length)
+	_, err := t.Storage.Piece(req.index).ReadAt(block, int64(req.begin))
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
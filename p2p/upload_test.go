@@ -0,0 +1,164 @@
+package p2p
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/bitfield"
+	"github.com/cedrickchee/min-torrent/message"
+	"github.com/cedrickchee/min-torrent/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUploadTorrent returns a torrent of three pieces stored in memory, the
+// last one short, of which we have pieces 0 and 2
+func newUploadTorrent() (*Torrent, error) {
+	length := 4*MaxBlockSize + 100
+	info := &storage.Info{
+		PieceLength: 2 * MaxBlockSize,
+		Length:      int64(length),
+		Files:       []storage.FileInfo{{Length: int64(length)}},
+	}
+	st, err := storage.NewMemory().OpenTorrent(info)
+	if err != nil {
+		return nil, err
+	}
+	t := &Torrent{
+		PieceHashes: make([][20]byte, 3),
+		PieceLength: info.PieceLength,
+		Length:      length,
+		Storage:     st,
+		have:        bitfield.New(3),
+		conns:       make(map[*peerConn]bool),
+	}
+	t.have.SetPiece(0)
+	t.have.SetPiece(2)
+	return t, nil
+}
+
+func TestCheckRequest(t *testing.T) {
+	tests := map[string]struct {
+		req   blockRequest
+		fails bool
+	}{
+		"block": {
+			req:   blockRequest{0, MaxBlockSize, MaxBlockSize},
+			fails: false,
+		},
+		"short block": {
+			req:   blockRequest{0, 0, 100},
+			fails: false,
+		},
+		"end of the last piece": {
+			req:   blockRequest{2, 0, 100},
+			fails: false,
+		},
+		"piece out of range": {
+			req:   blockRequest{3, 0, MaxBlockSize},
+			fails: true,
+		},
+		"negative piece": {
+			req:   blockRequest{-1, 0, MaxBlockSize},
+			fails: true,
+		},
+		"too long": {
+			req:   blockRequest{0, 0, MaxBlockSize + 1},
+			fails: true,
+		},
+		"empty": {
+			req:   blockRequest{0, 0, 0},
+			fails: true,
+		},
+		"past the end of the piece": {
+			req:   blockRequest{0, MaxBlockSize + 1, MaxBlockSize},
+			fails: true,
+		},
+		"past the end of the last piece": {
+			req:   blockRequest{2, 0, 101},
+			fails: true,
+		},
+		"negative offset": {
+			req:   blockRequest{0, -1, MaxBlockSize},
+			fails: true,
+		},
+		"piece we don't have": {
+			req:   blockRequest{1, 0, MaxBlockSize},
+			fails: true,
+		},
+	}
+
+	tr, err := newUploadTorrent()
+	require.Nil(t, err)
+	for name, test := range tests {
+		err := tr.checkRequest(test.req)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+	}
+}
+
+func TestUploaderQueue(t *testing.T) {
+	tr, err := newUploadTorrent()
+	require.Nil(t, err)
+	pc, msgs := newFakePeer()
+	defer pc.c.Conn.Close()
+	pc.t = tr
+	pc.uploader = newUploader(tr, pc.c)
+	pc.amChoking = false
+
+	first := blockRequest{0, 0, MaxBlockSize}
+	second := blockRequest{0, MaxBlockSize, MaxBlockSize}
+	third := blockRequest{2, 0, 100}
+	for _, req := range []blockRequest{first, second, third, second} {
+		require.Nil(t, pc.uploader.request(req))
+	}
+	assert.NotNil(t, pc.uploader.request(blockRequest{1, 0, MaxBlockSize}))
+	assert.Equal(t, []blockRequest{first, second, third}, pc.uploader.queue)
+
+	// A cancelled block is no longer sent
+	pc.uploader.cancel(second)
+	assert.Equal(t, []blockRequest{first, third}, pc.uploader.queue)
+
+	// Choking the peer discards its requests
+	require.Nil(t, pc.setChoking(true))
+	assert.Empty(t, pc.uploader.queue)
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, message.MsgChoke, msg.ID)
+	case <-time.After(time.Second):
+		t.Error("No Choke was sent")
+	}
+}
+
+func TestUploaderRun(t *testing.T) {
+	tr, err := newUploadTorrent()
+	require.Nil(t, err)
+	data := make([]byte, 2*MaxBlockSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	_, err = tr.Storage.Piece(0).WriteAt(data, 0)
+	require.Nil(t, err)
+
+	pc, msgs := newFakePeer()
+	defer pc.c.Conn.Close()
+	u := newUploader(tr, pc.c)
+	go u.run()
+	defer u.stop()
+
+	require.Nil(t, u.request(blockRequest{0, MaxBlockSize, MaxBlockSize}))
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, message.FormatPiece(0, MaxBlockSize, data[MaxBlockSize:]), msg)
+	case <-time.After(time.Second):
+		t.Fatal("No block was sent")
+	}
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&u.uploaded) == MaxBlockSize &&
+			atomic.LoadInt64(&tr.uploaded) == MaxBlockSize
+	}, time.Second, 10*time.Millisecond)
+}
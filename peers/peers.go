@@ -13,9 +13,19 @@ type Peer struct {
 	Port uint16
 }
 
-// Unmarshal parses peer IP addresses and ports from a buffer
+// Unmarshal parses IPv4 peer addresses and ports from a buffer
 func Unmarshal(peersBin []byte) ([]Peer, error) {
-	const peerSize = 6 // 4 for IP, 2 for port
+	return unmarshal(peersBin, net.IPv4len)
+}
+
+// Unmarshal6 parses IPv6 peer addresses and ports from a buffer, as found
+// in the peers6 key of tracker responses (BEP 7)
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	return unmarshal(peersBin, net.IPv6len)
+}
+
+func unmarshal(peersBin []byte, ipLen int) ([]Peer, error) {
+	peerSize := ipLen + 2 // IP followed by a 2 byte port
 	numPeers := len(peersBin) / peerSize
 	if len(peersBin)%peerSize != 0 {
 		err := errors.New("Received malformed peers")
@@ -24,8 +34,8 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 	peers := make([]Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
 		offset := i * peerSize
-		peers[i].IP = net.IP(peersBin[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+4 : offset+6]))
+		peers[i].IP = net.IP(peersBin[offset : offset+ipLen])
+		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+ipLen : offset+peerSize]))
 	}
 
 	return peers, nil
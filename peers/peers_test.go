@@ -39,6 +39,41 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+func TestUnmarshal6(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output []Peer
+		fails  bool
+	}{
+		"correctly parses peers": {
+			input: string([]byte{
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb,
+			}),
+			output: []Peer{
+				{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+				{IP: net.IPv6loopback, Port: 443},
+			},
+			fails: false,
+		},
+		"not enough bytes in peers": {
+			input:  string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0x1a, 0xe1}),
+			output: nil,
+			fails:  true,
+		},
+	}
+
+	for _, test := range tests {
+		peers, err := Unmarshal6([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.output, peers)
+	}
+}
+
 func TestString(t *testing.T) {
 	tests := []struct {
 		input  Peer
@@ -48,6 +83,14 @@ func TestString(t *testing.T) {
 			input:  Peer{IP: net.IP{127, 0, 0, 1}, Port: 6882},
 			output: "127.0.0.1:6882",
 		},
+		{
+			input:  Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+			output: "[2001:db8::1]:6881",
+		},
+		{
+			input:  Peer{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 6881},
+			output: "10.0.0.1:6881",
+		},
 	}
 	for _, test := range tests {
 		hostPort := test.input.String()
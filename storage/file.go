@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// fileStorage stores each torrent's files beneath a root path
+type fileStorage struct {
+	root     string
+	readOnly bool
+}
+
+// NewFile returns a storage that keeps a torrent's files on disk beneath
+// root. A single-file torrent is stored at root itself.
+func NewFile(root string) Storage {
+	return &fileStorage{root: root}
+}
+
+// NewFileReadOnly returns a storage that reads a torrent's files beneath
+// root as they are, without creating or resizing them. Reading the data of
+// a missing file, or past the end of a short one, fails, and so does any
+// write.
+func NewFileReadOnly(root string) Storage {
+	return &fileStorage{root: root, readOnly: true}
+}
+
+// OpenTorrent opens or creates the torrent's files, creating their
+// directories as needed. Each file is preallocated to its full length, so
+// that pieces can be written in any order. A read-only storage only opens
+// the files that exist.
+func (s *fileStorage) OpenTorrent(info *Info) (Torrent, error) {
+	fs := &fileStream{lengths: fileLengths(info)}
+	for _, fi := range info.Files {
+		path := filepath.Join(s.root, fi.Path)
+		if s.readOnly {
+			f, err := os.Open(path)
+			if err != nil && !os.IsNotExist(err) {
+				fs.Close()
+				return nil, err
+			}
+			fs.files = append(fs.files, f) // nil if missing
+			continue
+		}
+		f, err := openFile(path, fi.Length)
+		if err != nil {
+			fs.Close()
+			return nil, err
+		}
+		fs.files = append(fs.files, f)
+	}
+	return &streamTorrent{info: info, stream: fs}, nil
+}
+
+func openFile(path string, length int64) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if stat.Size() != length {
+		err = f.Truncate(length)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+var errMissingFile = errors.New("File is missing")
+
+// fileStream lays a torrent's files one after the other. Files that are
+// missing from a read-only storage are nil.
+type fileStream struct {
+	files   []*os.File
+	lengths []int64
+}
+
+func (s *fileStream) ReadAt(p []byte, off int64) (int, error) {
+	return span(s.lengths, p, off, func(i int, p []byte, off int64) (int, error) {
+		if s.files[i] == nil {
+			return 0, errMissingFile
+		}
+		return s.files[i].ReadAt(p, off)
+	})
+}
+
+func (s *fileStream) WriteAt(p []byte, off int64) (int, error) {
+	return span(s.lengths, p, off, func(i int, p []byte, off int64) (int, error) {
+		if s.files[i] == nil {
+			return 0, errMissingFile
+		}
+		return s.files[i].WriteAt(p, off)
+	})
+}
+
+func (s *fileStream) Close() error {
+	var firstErr error
+	for _, f := range s.files {
+		if f == nil {
+			continue
+		}
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "min-torrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	testStorage(t, NewFile(dir))
+
+	a, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("abc"), a)
+	empty, err := ioutil.ReadFile(filepath.Join(dir, "empty"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte{}, empty)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "sub", "b.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("defghij"), b)
+}
+
+func TestFileStorageSingleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "min-torrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data")
+	info := &Info{PieceLength: 4, Length: 5, Files: []FileInfo{{Length: 5}}}
+	st, err := NewFile(path).OpenTorrent(info)
+	require.Nil(t, err)
+	_, err = st.Piece(1).WriteAt([]byte("e"), 0)
+	require.Nil(t, err)
+	require.Nil(t, st.Close())
+
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("\x00\x00\x00\x00e"), data)
+}
+
+func TestOpenFilePreallocates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "min-torrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data")
+	err = ioutil.WriteFile(path, []byte("keep this and drop the rest"), 0644)
+	require.Nil(t, err)
+
+	f, err := openFile(path, 9)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("keep this"), data)
+
+	f, err = openFile(path, 12)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	data, err = ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("keep this\x00\x00\x00"), data)
+}
+
+func TestFileStorageReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "min-torrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// a.txt is complete, sub/b.txt is short and the empty file is missing
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("abc"), 0644))
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("def"), 0644))
+
+	st, err := NewFileReadOnly(dir).OpenTorrent(testInfo)
+	require.Nil(t, err)
+	defer st.Close()
+
+	tests := map[string]struct {
+		index  int
+		output string
+		fails  bool
+	}{
+		"complete piece": {
+			index:  0,
+			output: "abcd",
+			fails:  false,
+		},
+		"piece past the end of a short file": {
+			index:  1,
+			output: "ef\x00\x00",
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		buf := make([]byte, 4)
+		_, err := st.Piece(test.index).ReadAt(buf, 0)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, string(buf), name)
+	}
+
+	_, err = st.Piece(0).WriteAt([]byte("x"), 0)
+	assert.NotNil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "empty"))
+	assert.True(t, os.IsNotExist(err))
+}
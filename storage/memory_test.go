@@ -0,0 +1,7 @@
+package storage
+
+import "testing"
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemory())
+}
@@ -0,0 +1,85 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+)
+
+// mmapStorage memory-maps each torrent's files beneath a root path
+type mmapStorage struct {
+	root string
+}
+
+// NewMmap returns a storage that keeps a torrent's files on disk beneath
+// root, like NewFile, but accesses them through memory mappings
+func NewMmap(root string) Storage {
+	return &mmapStorage{root: root}
+}
+
+func (s *mmapStorage) OpenTorrent(info *Info) (Torrent, error) {
+	ms := &mmapStream{lengths: fileLengths(info)}
+	for _, fi := range info.Files {
+		region, err := mmapFile(filepath.Join(s.root, fi.Path), fi.Length)
+		if err != nil {
+			ms.Close()
+			return nil, err
+		}
+		ms.regions = append(ms.regions, region)
+	}
+	return &streamTorrent{info: info, stream: ms}, nil
+}
+
+func mmapFile(path string, length int64) ([]byte, error) {
+	f, err := openFile(path, length)
+	if err != nil {
+		return nil, err
+	}
+	// The mapping stays valid once the file is closed
+	defer f.Close()
+
+	if length == 0 {
+		return nil, nil // empty files can't be mapped
+	}
+	if int64(int(length)) != length {
+		return nil, fmt.Errorf("%s is too large to map", path)
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// mmapStream lays a torrent's mapped files one after the other
+type mmapStream struct {
+	regions [][]byte
+	lengths []int64
+}
+
+func (s *mmapStream) ReadAt(p []byte, off int64) (int, error) {
+	return span(s.lengths, p, off, func(i int, p []byte, off int64) (int, error) {
+		return copy(p, s.regions[i][off:]), nil
+	})
+}
+
+func (s *mmapStream) WriteAt(p []byte, off int64) (int, error) {
+	return span(s.lengths, p, off, func(i int, p []byte, off int64) (int, error) {
+		return copy(s.regions[i][off:], p), nil
+	})
+}
+
+// Close unmaps the files. Dirty pages are written back by the kernel.
+func (s *mmapStream) Close() error {
+	var firstErr error
+	for _, region := range s.regions {
+		if region == nil {
+			continue
+		}
+		err := syscall.Munmap(region)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.regions = nil
+	return firstErr
+}
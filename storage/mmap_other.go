@@ -0,0 +1,18 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package storage
+
+import "errors"
+
+type mmapStorage struct{}
+
+// NewMmap returns a storage that accesses files through memory mappings.
+// It isn't supported on this platform: opening a torrent always fails.
+func NewMmap(root string) Storage {
+	return &mmapStorage{}
+}
+
+func (s *mmapStorage) OpenTorrent(info *Info) (Torrent, error) {
+	return nil, errors.New("Memory-mapped storage is not supported on this platform")
+}
@@ -0,0 +1,26 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMmapStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "min-torrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	testStorage(t, NewMmap(dir))
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "sub", "b.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("defghij"), b)
+}
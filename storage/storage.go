@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+)
+
+// Storage holds the content of torrents
+type Storage interface {
+	// OpenTorrent makes room for a torrent's content, keeping whatever
+	// data is already stored for it
+	OpenTorrent(info *Info) (Torrent, error)
+}
+
+// Torrent is the content of one torrent, accessed piece by piece
+type Torrent interface {
+	Piece(index int) Piece
+	Close() error
+}
+
+// Piece is one piece of a torrent's content. Offsets are relative to the
+// start of the piece.
+type Piece interface {
+	io.ReaderAt
+	io.WriterAt
+	// MarkComplete is called once the piece's data has been verified
+	MarkComplete() error
+}
+
+// Info describes the layout of a torrent's content
+type Info struct {
+	InfoHash    [20]byte
+	Name        string
+	PieceLength int
+	Length      int64
+	Files       []FileInfo
+}
+
+// FileInfo describes one of the files a torrent's content is split across,
+// in order. Path is relative to where the torrent is stored; it is empty
+// for single-file torrents, which are stored at that location itself.
+type FileInfo struct {
+	Path   string
+	Length int64
+}
+
+// stream is a torrent's content addressed as a single run of bytes
+type stream interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// streamTorrent implements Torrent on top of a stream
+type streamTorrent struct {
+	info   *Info
+	stream stream
+}
+
+func (t *streamTorrent) Piece(index int) Piece {
+	begin := int64(index) * int64(t.info.PieceLength)
+	length := int64(t.info.PieceLength)
+	if begin+length > t.info.Length {
+		length = t.info.Length - begin
+	}
+	if index < 0 || length < 0 {
+		length = 0
+	}
+	return &streamPiece{stream: t.stream, index: index, begin: begin, length: length}
+}
+
+func (t *streamTorrent) Close() error {
+	return t.stream.Close()
+}
+
+type streamPiece struct {
+	stream stream
+	index  int
+	begin  int64
+	length int64
+}
+
+func (p *streamPiece) ReadAt(b []byte, off int64) (int, error) {
+	err := p.check(b, off)
+	if err != nil {
+		return 0, err
+	}
+	return p.stream.ReadAt(b, p.begin+off)
+}
+
+func (p *streamPiece) WriteAt(b []byte, off int64) (int, error) {
+	err := p.check(b, off)
+	if err != nil {
+		return 0, err
+	}
+	return p.stream.WriteAt(b, p.begin+off)
+}
+
+func (p *streamPiece) MarkComplete() error {
+	return nil
+}
+
+func (p *streamPiece) check(b []byte, off int64) error {
+	if off < 0 || off+int64(len(b)) > p.length {
+		return fmt.Errorf("Range [%d:%d] out of bounds for piece #%d of length %d", off, off+int64(len(b)), p.index, p.length)
+	}
+	return nil
+}
+
+// span applies a read or write of p at off to the consecutive segments of
+// the given lengths that it falls into. op is called with the segment's
+// index and the offset relative to that segment.
+func span(lengths []int64, p []byte, off int64, op func(i int, p []byte, off int64) (int, error)) (int, error) {
+	var total int64
+	for _, length := range lengths {
+		total += length
+	}
+	if off < 0 || off+int64(len(p)) > total {
+		return 0, fmt.Errorf("Range [%d:%d] out of bounds for length %d", off, off+int64(len(p)), total)
+	}
+
+	n := 0
+	var start int64
+	for i, length := range lengths {
+		if len(p) == 0 {
+			break
+		}
+		end := start + length
+		if off >= end {
+			start = end
+			continue
+		}
+		chunk := p
+		if int64(len(chunk)) > end-off {
+			chunk = chunk[:end-off]
+		}
+		m, err := op(i, chunk, off-start)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+		off += int64(m)
+		start = end
+	}
+	return n, nil
+}
+
+func fileLengths(info *Info) []int64 {
+	lengths := make([]int64, len(info.Files))
+	for i, f := range info.Files {
+		lengths[i] = f.Length
+	}
+	return lengths
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testInfo has 3 pieces of 4 bytes, the last one short, across 3 files
+var testInfo = &Info{
+	InfoHash:    [20]byte{1, 2, 3},
+	Name:        "test",
+	PieceLength: 4,
+	Length:      10,
+	Files: []FileInfo{
+		{Path: "a.txt", Length: 3},
+		{Path: "empty", Length: 0},
+		{Path: "sub/b.txt", Length: 7},
+	},
+}
+
+// testStorage checks the behavior every storage shares: pieces can be
+// written in any order, straddle files, and are still there once the
+// torrent is reopened
+func testStorage(t *testing.T, s Storage) {
+	st, err := s.OpenTorrent(testInfo)
+	require.Nil(t, err)
+
+	pieces := map[int]string{2: "ij", 0: "abcd", 1: "efgh"}
+	for index, data := range pieces {
+		n, err := st.Piece(index).WriteAt([]byte(data), 0)
+		require.Nil(t, err)
+		assert.Equal(t, len(data), n)
+		assert.Nil(t, st.Piece(index).MarkComplete())
+	}
+
+	buf := make([]byte, 2)
+	n, err := st.Piece(1).ReadAt(buf, 1)
+	require.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []byte("fg"), buf)
+
+	// Accesses can't go past the end of their piece
+	_, err = st.Piece(2).WriteAt([]byte("xyz"), 0)
+	assert.NotNil(t, err)
+	_, err = st.Piece(0).ReadAt(buf, 3)
+	assert.NotNil(t, err)
+	_, err = st.Piece(0).ReadAt(buf, -1)
+	assert.NotNil(t, err)
+	_, err = st.Piece(3).ReadAt(buf, 0)
+	assert.NotNil(t, err)
+	require.Nil(t, st.Close())
+
+	st, err = s.OpenTorrent(testInfo)
+	require.Nil(t, err)
+	defer st.Close()
+	for index, data := range pieces {
+		buf := make([]byte, len(data))
+		_, err := st.Piece(index).ReadAt(buf, 0)
+		require.Nil(t, err)
+		assert.Equal(t, data, string(buf))
+	}
+}
+
+func TestSpan(t *testing.T) {
+	type call struct {
+		i   int
+		p   string
+		off int64
+	}
+	tests := map[string]struct {
+		off   int64
+		p     string
+		calls []call
+		fails bool
+	}{
+		"within a segment": {
+			off:   4,
+			p:     "ab",
+			calls: []call{{2, "ab", 1}},
+		},
+		"across segments": {
+			off:   1,
+			p:     "abcde",
+			calls: []call{{0, "ab", 1}, {2, "cde", 0}},
+		},
+		"out of bounds": {
+			off:   8,
+			p:     "abc",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		var calls []call
+		n, err := span([]int64{3, 0, 7}, []byte(test.p), test.off, func(i int, p []byte, off int64) (int, error) {
+			calls = append(calls, call{i, string(p), off})
+			return len(p), nil
+		})
+		if test.fails {
+			assert.NotNil(t, err, name)
+			assert.Equal(t, 0, n, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, len(test.p), n, name)
+		}
+		assert.Equal(t, test.calls, calls, name)
+	}
+}
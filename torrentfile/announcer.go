@@ -0,0 +1,155 @@
+package torrentfile
+
+import (
+	"log"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/p2p"
+	"github.com/cedrickchee/min-torrent/peers"
+)
+
+// defaultInterval is used when no tracker told us how often to announce
+const defaultInterval = 30 * time.Minute
+
+// retryInterval is how long to wait after every tracker failed
+const retryInterval = time.Minute
+
+// stopTimeout bounds how long shutdown waits for the stopped announce
+const stopTimeout = 10 * time.Second
+
+// announcer keeps the trackers informed while a torrent is active. It
+// sends the started event, re-announces on the interval the trackers ask
+// for, and sends completed and stopped as the download progresses.
+type announcer struct {
+	t       *TorrentFile
+	tiers   *trackerTiers
+	peerID  [20]byte
+	port    uint16
+	stats   func() p2p.Stats   // transfer counters from the download engine
+	onPeers func([]peers.Peer) // receives peers found by re-announces
+	seeding bool               // the data was complete from the start
+
+	completed chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newAnnouncer(t *TorrentFile, peerID [20]byte, port uint16) *announcer {
+	return &announcer{
+		t:         t,
+		tiers:     newTrackerTiers(t),
+		peerID:    peerID,
+		port:      port,
+		stats:     func() p2p.Stats { return p2p.Stats{Left: int64(t.Length)} },
+		onPeers:   func([]peers.Peer) {},
+		completed: make(chan struct{}),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// start sends the started event and returns the trackers' response
+func (a *announcer) start() (*trackerResponse, error) {
+	return a.announce(eventStarted)
+}
+
+// startSeeding sends the completed event in place of started, for a
+// torrent whose data we already have
+func (a *announcer) startSeeding() (*trackerResponse, error) {
+	a.seeding = true
+	return a.announce(eventCompleted)
+}
+
+// run re-announces until stopped. first is the response to start or
+// startSeeding.
+func (a *announcer) run(first *trackerResponse) {
+	defer close(a.done)
+	completed := a.completed
+	if a.seeding {
+		completed = nil // already sent
+	}
+	timer := time.NewTimer(nextAnnounce(first))
+	defer timer.Stop()
+
+	for {
+		event := eventNone
+		select {
+		case <-timer.C:
+		case <-completed:
+			event = eventCompleted
+			completed = nil // only ever sent once
+		case <-a.stop:
+			select {
+			case <-completed:
+				a.announce(eventCompleted) // finished right before stopping
+			default:
+			}
+			a.announce(eventStopped)
+			return
+		}
+
+		resp, err := a.announce(event)
+		if err == nil {
+			a.onPeers(resp.peers)
+		}
+		if event == eventNone || err != nil {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(nextAnnounce(resp))
+		}
+	}
+}
+
+// complete tells the trackers that the download finished
+func (a *announcer) complete() {
+	close(a.completed)
+}
+
+// shutdown sends the stopped event and waits, for a bounded time, for the
+// announcer to finish
+func (a *announcer) shutdown() {
+	close(a.stop)
+	select {
+	case <-a.done:
+	case <-time.After(stopTimeout):
+		log.Println("Gave up waiting for trackers to acknowledge stop")
+	}
+}
+
+func (a *announcer) announce(event string) (*trackerResponse, error) {
+	stats := a.stats()
+	params := announceParams{
+		peerID:     a.peerID,
+		port:       a.port,
+		uploaded:   stats.Uploaded,
+		downloaded: stats.Downloaded,
+		left:       stats.Left,
+		event:      event,
+		ipv6:       localIPv6(),
+	}
+	resp, err := a.t.announce(a.tiers, params)
+	if err != nil {
+		log.Println(err)
+	}
+	return resp, err
+}
+
+// nextAnnounce picks the delay before the next announce, honoring the
+// tracker's interval and min interval
+func nextAnnounce(resp *trackerResponse) time.Duration {
+	if resp == nil {
+		return retryInterval
+	}
+	interval := resp.interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	if interval < resp.minInterval {
+		interval = resp.minInterval
+	}
+	return interval
+}
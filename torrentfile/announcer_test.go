@@ -0,0 +1,160 @@
+package torrentfile
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/p2p"
+	"github.com/cedrickchee/min-torrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextAnnounce(t *testing.T) {
+	tests := map[string]struct {
+		input  *trackerResponse
+		output time.Duration
+	}{
+		"tracker failed": {
+			input:  nil,
+			output: retryInterval,
+		},
+		"interval": {
+			input:  &trackerResponse{interval: 900 * time.Second},
+			output: 900 * time.Second,
+		},
+		"min interval wins over a shorter interval": {
+			input:  &trackerResponse{interval: 10 * time.Second, minInterval: 60 * time.Second},
+			output: 60 * time.Second,
+		},
+		"no interval": {
+			input:  &trackerResponse{},
+			output: defaultInterval,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.output, nextAnnounce(test.input))
+	}
+}
+
+func TestAnnouncerLifecycle(t *testing.T) {
+	var mu sync.Mutex
+	var queries []url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.Query())
+		n := len(queries)
+		mu.Unlock()
+		// Each announce reveals one more peer
+		w.Write([]byte("d8:intervali1e5:peers6:" + string([]byte{10, 0, 0, byte(n), 0x1A, 0xE1}) + "e"))
+	}))
+	defer ts.Close()
+
+	tf := TorrentFile{Announce: ts.URL, Length: 1000}
+	a := newAnnouncer(&tf, [20]byte{1}, 6881)
+	first, err := a.start()
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{10, 0, 0, 1}, Port: 6881}}, first.peers)
+
+	found := make(chan []peers.Peer, 10)
+	a.stats = func() p2p.Stats { return p2p.Stats{Downloaded: 600, Uploaded: 50, Left: 400} }
+	a.onPeers = func(p []peers.Peer) { found <- p }
+	go a.run(first)
+
+	// Re-announce after the interval and hand new peers to the download
+	select {
+	case p := <-found:
+		assert.Equal(t, []peers.Peer{{IP: net.IP{10, 0, 0, 2}, Port: 6881}}, p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No re-announce")
+	}
+
+	a.complete()
+	<-found
+	a.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, queries, 4)
+	assert.Equal(t, "started", queries[0].Get("event"))
+	assert.Equal(t, "1000", queries[0].Get("left"))
+	assert.Equal(t, "", queries[1].Get("event"))
+	assert.Equal(t, "600", queries[1].Get("downloaded"))
+	assert.Equal(t, "50", queries[1].Get("uploaded"))
+	assert.Equal(t, "400", queries[1].Get("left"))
+	assert.Equal(t, "completed", queries[2].Get("event"))
+	assert.Equal(t, "stopped", queries[3].Get("event"))
+}
+
+func TestAnnouncerCompleteThenShutdown(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer ts.Close()
+
+	// Either event may be seen first by run; completed must never be lost
+	for i := 0; i < 20; i++ {
+		mu.Lock()
+		events = nil
+		mu.Unlock()
+
+		tf := TorrentFile{Announce: ts.URL, Length: 1000}
+		a := newAnnouncer(&tf, [20]byte{1}, 6881)
+		first, err := a.start()
+		require.Nil(t, err)
+		go a.run(first)
+		a.complete()
+		a.shutdown()
+
+		mu.Lock()
+		assert.Equal(t, []string{"started", "completed", "stopped"}, events)
+		mu.Unlock()
+	}
+}
+
+func TestAnnouncerSeeding(t *testing.T) {
+	var mu sync.Mutex
+	var queries []url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.Query())
+		mu.Unlock()
+		w.Write([]byte("d8:intervali1e5:peers0:e"))
+	}))
+	defer ts.Close()
+
+	tf := TorrentFile{Announce: ts.URL, Length: 1000}
+	a := newAnnouncer(&tf, [20]byte{1}, 6881)
+	a.stats = func() p2p.Stats { return p2p.Stats{} }
+	first, err := a.startSeeding()
+	require.Nil(t, err)
+
+	found := make(chan []peers.Peer, 10)
+	a.onPeers = func(p []peers.Peer) { found <- p }
+	go a.run(first)
+	select {
+	case <-found:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No re-announce")
+	}
+	a.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.True(t, len(queries) >= 3)
+	assert.Equal(t, "completed", queries[0].Get("event"))
+	assert.Equal(t, "0", queries[0].Get("left"))
+	assert.Equal(t, "", queries[1].Get("event"))
+	assert.Equal(t, "stopped", queries[len(queries)-1].Get("event"))
+}
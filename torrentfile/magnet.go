@@ -0,0 +1,68 @@
+package torrentfile
+
+import (
+	"log"
+
+	"github.com/cedrickchee/min-torrent/bencode"
+	"github.com/cedrickchee/min-torrent/magnet"
+	"github.com/cedrickchee/min-torrent/metadata"
+)
+
+// OpenMagnet resolves a magnet URI into a TorrentFile. It finds peers
+// through the URI's trackers and peer addresses, then downloads the info
+// dictionary from them (BEP 9).
+func OpenMagnet(uri string) (TorrentFile, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	peerID, err := newPeerID()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	swarm := resolvePeers(m.Peers)
+	if len(m.Trackers) > 0 {
+		// We don't know the torrent's length yet, so announce what we have
+		t := TorrentFile{InfoHash: m.InfoHash, AnnounceList: magnetTiers(m)}
+		found, err := t.getPeers(peerID, port)
+		if err != nil {
+			log.Println(err)
+		}
+		swarm = append(swarm, found...)
+	}
+
+	log.Printf("Fetching metadata from %d peers", len(swarm))
+	info, err := metadata.Fetch(swarm, peerID, m.InfoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return fromMagnetInfo(m, info)
+}
+
+// fromMagnetInfo builds a TorrentFile from a verified info dictionary
+func fromMagnetInfo(m magnet.Magnet, info []byte) (TorrentFile, error) {
+	bto := bencodeTorrent{}
+	err := bencode.Unmarshal(info, &bto.Info)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	if len(m.Trackers) > 0 {
+		bto.Announce = m.Trackers[0]
+		bto.AnnounceList = magnetTiers(m)
+	}
+	if bto.Info.Name == "" {
+		bto.Info.Name = m.DisplayName
+	}
+	return bto.toTorrentFile()
+}
+
+// magnetTiers puts each of the magnet's trackers in a tier of its own, so
+// that all of them are announced to
+func magnetTiers(m magnet.Magnet) [][]string {
+	tiers := make([][]string, len(m.Trackers))
+	for i, tracker := range m.Trackers {
+		tiers[i] = []string{tracker}
+	}
+	return tiers
+}
@@ -0,0 +1,36 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"testing"
+
+	"github.com/cedrickchee/min-torrent/magnet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromMagnetInfo(t *testing.T) {
+	info := []byte("d6:lengthi262244e4:name31:debian-10.2.0-amd64-netinst.iso12:piece lengthi262144e6:pieces40:1234567890abcdefghijabcdefghij1234567890e")
+	m := magnet.Magnet{
+		InfoHash: sha1.Sum(info),
+		Trackers: []string{"http://bttracker.debian.org:6969/announce"},
+	}
+
+	to, err := fromMagnetInfo(m, info)
+	require.Nil(t, err)
+	expected := TorrentFile{
+		Name:     "debian-10.2.0-amd64-netinst.iso",
+		Announce: "http://bttracker.debian.org:6969/announce",
+		AnnounceList: [][]string{
+			{"http://bttracker.debian.org:6969/announce"},
+		},
+		InfoHash: [20]byte{32, 193, 77, 241, 109, 71, 83, 114, 100, 5, 103, 197, 83, 215, 214, 155, 121, 206, 86, 70},
+		PieceHashes: [][20]byte{
+			{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
+			{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
+		},
+		PieceLength: 262144,
+		Length:      262244,
+	}
+	assert.Equal(t, expected, to)
+}
@@ -0,0 +1,126 @@
+package torrentfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cedrickchee/min-torrent/bencode"
+	"github.com/cedrickchee/min-torrent/bitfield"
+)
+
+// The fast-resume file sits next to the downloaded data. It records the
+// pieces that were verified when the download stopped, along with the size
+// and modification time of every file, so that the pieces can be trusted
+// without hashing them again as long as the files weren't touched since.
+const resumeSuffix = ".resume"
+
+type bencodeResume struct {
+	InfoHash string              `bencode:"info hash"`
+	Bitfield string              `bencode:"bitfield"`
+	Files    []bencodeResumeFile `bencode:"files"`
+}
+
+type bencodeResumeFile struct {
+	Path   string `bencode:"path"`
+	Length int64  `bencode:"length"`
+	Mtime  int64  `bencode:"mtime"` // nanoseconds since the Unix epoch
+}
+
+func resumePath(path string) string {
+	return filepath.Clean(path) + resumeSuffix
+}
+
+// loadResume finds out which pieces of a previous download to path can be
+// trusted. If the resume file matches the data on disk, its pieces are
+// returned. Otherwise check tells whether there is data to hash-check.
+func (t *TorrentFile) loadResume(path string) (have bitfield.Bitfield, check bool) {
+	files, exist, err := t.statFiles(path)
+	if err != nil || !exist {
+		return nil, exist
+	}
+
+	data, err := ioutil.ReadFile(resumePath(path))
+	if err != nil {
+		return nil, true
+	}
+	var res bencodeResume
+	err = bencode.Unmarshal(data, &res)
+	if err != nil {
+		return nil, true
+	}
+
+	have = bitfield.Bitfield(res.Bitfield)
+	if res.InfoHash != string(t.InfoHash[:]) || len(have) != len(bitfield.New(len(t.PieceHashes))) {
+		return nil, true
+	}
+	if len(res.Files) != len(files) {
+		return nil, true
+	}
+	for i := range files {
+		if res.Files[i] != files[i] {
+			return nil, true
+		}
+	}
+	return have, false
+}
+
+// saveResume records the pieces of the download to path that are verified.
+// It must be called once nothing writes to the files anymore, or their
+// modification times won't match the next time.
+func (t *TorrentFile) saveResume(path string, have bitfield.Bitfield) error {
+	files, _, err := t.statFiles(path)
+	if err != nil {
+		return err
+	}
+	data, err := bencode.Marshal(bencodeResume{
+		InfoHash: string(t.InfoHash[:]),
+		Bitfield: string(have),
+		Files:    files,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave half a file
+	tmp := resumePath(path) + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, resumePath(path))
+}
+
+// removeResume deletes the resume file once the download is complete
+func removeResume(path string) error {
+	err := os.Remove(resumePath(path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// statFiles describes the torrent's files under path as they are on disk.
+// Missing files are recorded with a length of -1. Returns whether any file
+// exists.
+func (t *TorrentFile) statFiles(path string) ([]bencodeResumeFile, bool, error) {
+	var files []bencodeResumeFile
+	exist := false
+	for _, f := range t.storageInfo().Files {
+		entry := bencodeResumeFile{Path: f.Path, Length: -1}
+		stat, err := os.Stat(filepath.Join(path, f.Path))
+		if err == nil {
+			if stat.IsDir() {
+				return nil, false, fmt.Errorf("%s is a directory", filepath.Join(path, f.Path))
+			}
+			entry.Length = stat.Size()
+			entry.Mtime = stat.ModTime().UnixNano()
+			exist = true
+		} else if !os.IsNotExist(err) {
+			return nil, false, err
+		}
+		files = append(files, entry)
+	}
+	return files, exist, nil
+}
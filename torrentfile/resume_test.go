@@ -0,0 +1,141 @@
+package torrentfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/bitfield"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResume(t *testing.T) {
+	tests := map[string]struct {
+		write  bool                               // write the data file
+		save   bool                               // save a resume file
+		change func(tf *TorrentFile, path string) // applied after saving
+		have   bitfield.Bitfield
+		check  bool
+	}{
+		"nothing downloaded": {
+			write: false,
+			save:  false,
+			have:  nil,
+			check: false,
+		},
+		"data without resume file": {
+			write: true,
+			save:  false,
+			have:  nil,
+			check: true,
+		},
+		"unchanged data": {
+			write: true,
+			save:  true,
+			have:  bitfield.Bitfield{0b10100000},
+			check: false,
+		},
+		"modified data": {
+			write: true,
+			save:  true,
+			change: func(tf *TorrentFile, path string) {
+				later := time.Now().Add(time.Hour)
+				os.Chtimes(path, later, later)
+			},
+			have:  nil,
+			check: true,
+		},
+		"resized data": {
+			write: true,
+			save:  true,
+			change: func(tf *TorrentFile, path string) {
+				os.Truncate(path, 5)
+			},
+			have:  nil,
+			check: true,
+		},
+		"other torrent": {
+			write: true,
+			save:  true,
+			change: func(tf *TorrentFile, path string) {
+				tf.InfoHash[0]++
+			},
+			have:  nil,
+			check: true,
+		},
+		"corrupt resume file": {
+			write: true,
+			save:  true,
+			change: func(tf *TorrentFile, path string) {
+				ioutil.WriteFile(resumePath(path), []byte("d4:info"), 0644)
+			},
+			have:  nil,
+			check: true,
+		},
+	}
+
+	for name, test := range tests {
+		dir, err := ioutil.TempDir("", "resume")
+		require.Nil(t, err, name)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "data")
+
+		tf := &TorrentFile{
+			InfoHash:    [20]byte{1, 2, 3},
+			PieceHashes: make([][20]byte, 3),
+			PieceLength: 4,
+			Length:      10,
+		}
+		if test.write {
+			require.Nil(t, ioutil.WriteFile(path, make([]byte, 10), 0644), name)
+		}
+		if test.save {
+			require.Nil(t, tf.saveResume(path, bitfield.Bitfield{0b10100000}), name)
+		}
+		if test.change != nil {
+			test.change(tf, path)
+		}
+
+		have, check := tf.loadResume(path)
+		assert.Equal(t, test.have, have, name)
+		assert.Equal(t, test.check, check, name)
+	}
+}
+
+func TestResumeMultiFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tf := &TorrentFile{
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: make([][20]byte, 2),
+		PieceLength: 4,
+		Length:      6,
+		Files: []File{
+			{Path: []string{"a"}, Length: 2},
+			{Path: []string{"sub", "b"}, Length: 4, Offset: 2},
+		},
+	}
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), make([]byte, 2), 0644))
+
+	// One of the files is missing, which is recorded as well
+	require.Nil(t, tf.saveResume(dir, bitfield.Bitfield{0b10000000}))
+	have, check := tf.loadResume(dir)
+	assert.Equal(t, bitfield.Bitfield{0b10000000}, have)
+	assert.False(t, check)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sub", "b"), make([]byte, 4), 0644))
+	have, check = tf.loadResume(dir)
+	assert.Nil(t, have)
+	assert.True(t, check)
+
+	require.Nil(t, removeResume(dir))
+	_, err = os.Stat(resumePath(dir))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, removeResume(dir))
+}
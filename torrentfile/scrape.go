@@ -0,0 +1,168 @@
+package torrentfile
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/bencode"
+)
+
+// scrapeTimeout bounds a scrape, retransmissions to UDP trackers included.
+// Statistics aren't worth the long wait an announce may take. A variable
+// so tests can shorten it.
+var scrapeTimeout = 30 * time.Second
+
+// ScrapeResult holds one tracker's statistics for a torrent
+type ScrapeResult struct {
+	Tracker   string
+	Seeders   int
+	Leechers  int
+	Completed int   // number of times the torrent was downloaded in full
+	Err       error // set when the tracker could not be scraped
+}
+
+type bencodeScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+type bencodeScrapeResponse struct {
+	FailureReason string                       `bencode:"failure reason"`
+	Files         map[string]bencodeScrapeFile `bencode:"files"` // keyed by info hash
+}
+
+// Scrape asks each of the torrent's trackers for swarm statistics. The
+// trackers are queried concurrently and results are returned in the order
+// the trackers are listed in the torrent.
+func (t *TorrentFile) Scrape() []ScrapeResult {
+	trackers := t.trackers()
+	results := make([]ScrapeResult, len(trackers))
+	var wg sync.WaitGroup
+	for i, tracker := range trackers {
+		wg.Add(1)
+		go func(i int, tracker string) {
+			defer wg.Done()
+			results[i] = t.scrapeFrom(tracker)
+			results[i].Tracker = tracker
+		}(i, tracker)
+	}
+	wg.Wait()
+	return results
+}
+
+// trackers lists every tracker of the torrent once, tier by tier
+func (t *TorrentFile) trackers() []string {
+	tiers := t.AnnounceList
+	if len(tiers) == 0 && t.Announce != "" {
+		tiers = [][]string{{t.Announce}}
+	}
+
+	var trackers []string
+	seen := map[string]bool{}
+	for _, tier := range tiers {
+		for _, tracker := range tier {
+			if tracker != "" && !seen[tracker] {
+				seen[tracker] = true
+				trackers = append(trackers, tracker)
+			}
+		}
+	}
+	return trackers
+}
+
+// scrapeFrom scrapes a single tracker, choosing the protocol by the
+// announce URL's scheme
+func (t *TorrentFile) scrapeFrom(announce string) ScrapeResult {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return ScrapeResult{Err: err}
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return t.scrapeHTTP(announce)
+	case "udp":
+		return t.scrapeUDP(u.Host)
+	default:
+		return ScrapeResult{Err: fmt.Errorf("Unsupported tracker protocol %q", u.Scheme)}
+	}
+}
+
+func (t *TorrentFile) scrapeHTTP(announce string) ScrapeResult {
+	scrape, err := scrapeURL(announce)
+	if err != nil {
+		return ScrapeResult{Err: err}
+	}
+	u, err := url.Parse(scrape)
+	if err != nil {
+		return ScrapeResult{Err: err}
+	}
+	query := u.Query()
+	query.Set("info_hash", string(t.InfoHash[:]))
+	u.RawQuery = query.Encode()
+
+	client := &http.Client{Timeout: scrapeTimeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return ScrapeResult{Err: err}
+	}
+	defer resp.Body.Close()
+
+	scrapeResp := bencodeScrapeResponse{}
+	err = bencode.NewDecoder(resp.Body).Decode(&scrapeResp)
+	if err != nil {
+		return ScrapeResult{Err: err}
+	}
+	if scrapeResp.FailureReason != "" {
+		return ScrapeResult{Err: &TrackerError{Tracker: announce, Reason: scrapeResp.FailureReason}}
+	}
+	file, ok := scrapeResp.Files[string(t.InfoHash[:])]
+	if !ok {
+		return ScrapeResult{Err: fmt.Errorf("Tracker %s does not know torrent %x", announce, t.InfoHash)}
+	}
+	return ScrapeResult{
+		Seeders:   file.Complete,
+		Leechers:  file.Incomplete,
+		Completed: file.Downloaded,
+	}
+}
+
+func (t *TorrentFile) scrapeUDP(addr string) ScrapeResult {
+	tracker, err := dialUDPTracker(addr, time.Now().Add(scrapeTimeout))
+	if err != nil {
+		return ScrapeResult{Err: err}
+	}
+	defer tracker.Close()
+
+	stats, err := tracker.scrape([][20]byte{t.InfoHash})
+	if err != nil {
+		return ScrapeResult{Err: err}
+	}
+	return ScrapeResult{
+		Seeders:   stats[0].seeders,
+		Leechers:  stats[0].leechers,
+		Completed: stats[0].completed,
+	}
+}
+
+// scrapeURL derives a tracker's scrape URL from its announce URL. By
+// convention, the last path segment must begin with "announce", which is
+// replaced by "scrape"; trackers whose URL doesn't follow this don't
+// support scraping.
+func scrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	if slash < 0 || !strings.HasPrefix(u.Path[slash+1:], "announce") {
+		return "", fmt.Errorf("Tracker %s does not support scrape", announce)
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(u.Path[slash+1:], "announce")
+	u.RawPath = ""
+	return u.String(), nil
+}
@@ -0,0 +1,114 @@
+package torrentfile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output string
+		fails  bool
+	}{
+		"announce": {
+			input:  "http://example.com/announce",
+			output: "http://example.com/scrape",
+			fails:  false,
+		},
+		"announce with suffix and query": {
+			input:  "http://example.com/x/announce.php?passkey=abc",
+			output: "http://example.com/x/scrape.php?passkey=abc",
+			fails:  false,
+		},
+		"last segment is not announce": {
+			input:  "http://example.com/announce/x",
+			output: "",
+			fails:  true,
+		},
+		"no path": {
+			input:  "http://example.com",
+			output: "",
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		u, err := scrapeURL(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, u, name)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	infoHash := [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182}
+	var queried []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		queried = append(queried, r.URL.Query().Get("info_hash"))
+		w.Write([]byte("d5:filesd20:" + string(infoHash[:]) +
+			"d8:completei5e10:downloadedi50e10:incompletei10eeee"))
+	}))
+	defer ts.Close()
+
+	udp := newMockUDPTracker(t, nil)
+	defer udp.Close()
+
+	tf := TorrentFile{
+		Announce: ts.URL + "/announce",
+		AnnounceList: [][]string{
+			{ts.URL + "/announce", "udp://" + udp.addr() + "/announce"},
+			{ts.URL + "/tracker", ts.URL + "/announce"},
+		},
+		InfoHash: infoHash,
+	}
+	results := tf.Scrape()
+	require.Len(t, results, 3)
+
+	assert.Equal(t, ScrapeResult{Tracker: ts.URL + "/announce", Seeders: 5, Leechers: 10, Completed: 50}, results[0])
+	assert.Equal(t, ScrapeResult{Tracker: "udp://" + udp.addr() + "/announce", Seeders: 7, Leechers: 3, Completed: 42}, results[1])
+	assert.Equal(t, ts.URL+"/tracker", results[2].Tracker)
+	assert.NotNil(t, results[2].Err)
+	assert.Equal(t, []string{string(infoHash[:])}, queried)
+}
+
+func TestScrapeUnknownTorrent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d5:filesdee"))
+	}))
+	defer ts.Close()
+
+	tf := TorrentFile{Announce: ts.URL + "/announce"}
+	results := tf.Scrape()
+	require.Len(t, results, 1)
+	assert.NotNil(t, results[0].Err)
+}
+
+func TestScrapeTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) { scrapeTimeout = timeout }(scrapeTimeout)
+	scrapeTimeout = 50 * time.Millisecond
+
+	udp := newMockUDPTracker(t, nil)
+	defer udp.Close()
+	udp.drop(100)
+
+	tf := TorrentFile{Announce: "udp://" + udp.addr() + "/announce"}
+	start := time.Now()
+	results := tf.Scrape()
+	require.Len(t, results, 1)
+	assert.NotNil(t, results[0].Err)
+	// Much sooner than the first retransmission
+	assert.True(t, time.Since(start) < udpTimeout, time.Since(start))
+}
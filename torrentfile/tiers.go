@@ -0,0 +1,176 @@
+package torrentfile
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// trackerTiers holds a torrent's trackers as tiers (BEP 12). Trackers
+// within a tier are shuffled once, then tried in order; whichever responds
+// moves to the front of its tier so it is tried first next time.
+type trackerTiers struct {
+	mu         sync.Mutex
+	tiers      [][]string
+	trackerIDs map[string]string // tracker ids to echo back, by tracker URL
+}
+
+func newTrackerTiers(t *TorrentFile) *trackerTiers {
+	var tiers [][]string
+	for _, tier := range t.AnnounceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, append([]string(nil), tier...))
+		}
+	}
+	// The announce-list supersedes announce when it is present
+	if len(tiers) == 0 && t.Announce != "" {
+		tiers = [][]string{{t.Announce}}
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, tier := range tiers {
+		rng.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+	}
+	return &trackerTiers{tiers: tiers, trackerIDs: map[string]string{}}
+}
+
+// snapshot returns a copy of the tiers in their current order
+func (tt *trackerTiers) snapshot() [][]string {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tiers := make([][]string, len(tt.tiers))
+	for i, tier := range tt.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	return tiers
+}
+
+// promote moves a tracker that responded to the front of its tier
+func (tt *trackerTiers) promote(tracker string) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	for _, tier := range tt.tiers {
+		for i, tr := range tier {
+			if tr == tracker {
+				copy(tier[1:i+1], tier[:i])
+				tier[0] = tracker
+				return
+			}
+		}
+	}
+}
+
+func (tt *trackerTiers) trackerID(tracker string) string {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	return tt.trackerIDs[tracker]
+}
+
+func (tt *trackerTiers) setTrackerID(tracker, id string) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if tt.trackerIDs == nil {
+		tt.trackerIDs = map[string]string{}
+	}
+	tt.trackerIDs[tracker] = id
+}
+
+// announceTimeout bounds an announce to a single tracker, retransmissions
+// included, so that a dead tracker doesn't hold up the announce for the
+// whole BEP 15 schedule. A variable so tests can shorten it.
+var announceTimeout = time.Minute
+
+// announce announces to every tier at once. Within a tier, trackers are
+// tried in order until one responds (BEP 12); a tier where every tracker
+// fails is skipped over. Peers from the responding tracker of each tier
+// are merged. The merged response asks to be re-announced at the shortest
+// interval any tracker requested, but no sooner than the strictest minimum
+// interval.
+func (t *TorrentFile) announce(tiers *trackerTiers, params announceParams) (*trackerResponse, error) {
+	snapshot := tiers.snapshot()
+	if len(snapshot) == 0 {
+		return nil, errors.New("Torrent has no trackers")
+	}
+
+	resps := make([]*trackerResponse, len(snapshot))
+	errs := make([]error, len(snapshot))
+	var wg sync.WaitGroup
+	for i, tier := range snapshot {
+		wg.Add(1)
+		go func(i int, tier []string) {
+			defer wg.Done()
+			resps[i], errs[i] = t.announceTier(tiers, tier, params)
+		}(i, tier)
+	}
+	wg.Wait()
+
+	var merged *trackerResponse
+	seen := make(map[string]bool)
+	var lastErr error
+	for i, resp := range resps {
+		if resp == nil {
+			lastErr = errs[i]
+			continue
+		}
+		if merged == nil {
+			merged = &trackerResponse{interval: resp.interval, minInterval: resp.minInterval}
+		}
+		if resp.interval > 0 && (merged.interval <= 0 || resp.interval < merged.interval) {
+			merged.interval = resp.interval
+		}
+		if resp.minInterval > merged.minInterval {
+			merged.minInterval = resp.minInterval
+		}
+		if resp.seeders > merged.seeders {
+			merged.seeders = resp.seeders
+		}
+		if resp.leechers > merged.leechers {
+			merged.leechers = resp.leechers
+		}
+		for _, p := range resp.peers {
+			if !seen[p.String()] {
+				seen[p.String()] = true
+				merged.peers = append(merged.peers, p)
+			}
+		}
+	}
+	if merged == nil {
+		if _, ok := lastErr.(*TrackerError); ok {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("No tracker responded: %v", lastErr)
+	}
+	return merged, nil
+}
+
+// announceTier tries the trackers of a tier in order until one responds,
+// and promotes it. Returns the last error if none did.
+func (t *TorrentFile) announceTier(tiers *trackerTiers, tier []string, params announceParams) (*trackerResponse, error) {
+	var lastErr error
+	for _, tracker := range tier {
+		log.Println("Connecting with tracker", tracker)
+		params.trackerID = tiers.trackerID(tracker)
+		resp, err := t.announceTo(tracker, params, announceTimeout)
+		if err != nil {
+			if _, ok := err.(*TrackerError); ok {
+				log.Println(err)
+			} else {
+				log.Printf("Tracker %s failed: %v\n", tracker, err)
+			}
+			lastErr = err
+			continue
+		}
+		tiers.promote(tracker)
+		if resp.trackerID != "" {
+			tiers.setTrackerID(tracker, resp.trackerID)
+		}
+		if resp.warning != "" {
+			log.Printf("Tracker %s warning: %s\n", tracker, resp.warning)
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,155 @@
+package torrentfile
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMockTracker serves a compact peer list over HTTP
+func newMockTracker(peersBin []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers" + strconv.Itoa(len(peersBin)) + ":" + string(peersBin) + "e"))
+	}))
+}
+
+func TestNewTrackerTiers(t *testing.T) {
+	tests := map[string]struct {
+		input  TorrentFile
+		output [][]string
+	}{
+		"announce only": {
+			input:  TorrentFile{Announce: "http://a"},
+			output: [][]string{{"http://a"}},
+		},
+		"announce-list supersedes announce": {
+			input: TorrentFile{
+				Announce:     "http://a",
+				AnnounceList: [][]string{{"http://b"}, {}, {"http://c"}},
+			},
+			output: [][]string{{"http://b"}, {"http://c"}},
+		},
+		"no trackers": {
+			input:  TorrentFile{},
+			output: [][]string{},
+		},
+	}
+
+	for _, test := range tests {
+		tiers := newTrackerTiers(&test.input)
+		assert.Equal(t, test.output, tiers.snapshot())
+	}
+}
+
+func TestNewTrackerTiersShuffles(t *testing.T) {
+	tier := []string{"http://a", "http://b", "http://c", "http://d", "http://e"}
+	tf := TorrentFile{AnnounceList: [][]string{tier}}
+	for i := 0; i < 100; i++ {
+		shuffled := newTrackerTiers(&tf).snapshot()[0]
+		assert.ElementsMatch(t, tier, shuffled)
+		if shuffled[0] != tier[0] || shuffled[1] != tier[1] {
+			return
+		}
+	}
+	t.Error("Tier was never shuffled")
+}
+
+func TestAnnounceFailsOver(t *testing.T) {
+	dead := newMockTracker(nil)
+	dead.Close()
+	first := newMockTracker([]byte{10, 0, 1, 8, 0x1B, 0x50, 127, 0, 0, 1, 0x1B, 0x51})
+	defer first.Close()
+	second := newMockTracker([]byte{127, 0, 0, 1, 0x1B, 0x51, 127, 0, 0, 2, 0x1B, 0x52})
+	defer second.Close()
+	unused := newMockTracker([]byte{127, 0, 0, 3, 0x1B, 0x53})
+	defer unused.Close()
+
+	tf := TorrentFile{}
+	tiers := &trackerTiers{tiers: [][]string{
+		{dead.URL, first.URL, unused.URL},
+		{dead.URL + "/unreachable", second.URL},
+		{dead.URL},
+	}}
+
+	resp, err := tf.announce(tiers, announceParams{port: 6881})
+	require.Nil(t, err)
+	// Peers from the first responding tracker of each tier, without the
+	// duplicate
+	expected := []peers.Peer{
+		{IP: net.IP{10, 0, 1, 8}, Port: 6992},
+		{IP: net.IP{127, 0, 0, 1}, Port: 6993},
+		{IP: net.IP{127, 0, 0, 2}, Port: 6994},
+	}
+	assert.Equal(t, expected, resp.peers)
+	assert.Equal(t, 900*time.Second, resp.interval)
+
+	// Trackers that responded were promoted within their tier
+	assert.Equal(t, [][]string{
+		{first.URL, dead.URL, unused.URL},
+		{second.URL, dead.URL + "/unreachable"},
+		{dead.URL},
+	}, tiers.snapshot())
+}
+
+func TestAnnounceGivesUpOnSilentTrackers(t *testing.T) {
+	defer func(timeout time.Duration) { announceTimeout = timeout }(announceTimeout)
+	announceTimeout = 50 * time.Millisecond
+
+	silent := newMockUDPTracker(t, nil)
+	defer silent.Close()
+	silent.drop(100)
+	working := newMockTracker([]byte{127, 0, 0, 2, 0x1B, 0x52})
+	defer working.Close()
+
+	tests := map[string]struct {
+		tiers [][]string
+		peers []peers.Peer
+		fails bool
+	}{
+		"fails over within a tier": {
+			tiers: [][]string{{"udp://" + silent.addr(), working.URL}},
+			peers: []peers.Peer{{IP: net.IP{127, 0, 0, 2}, Port: 6994}},
+			fails: false,
+		},
+		"other tiers are still used": {
+			tiers: [][]string{{"udp://" + silent.addr()}, {working.URL}},
+			peers: []peers.Peer{{IP: net.IP{127, 0, 0, 2}, Port: 6994}},
+			fails: false,
+		},
+		"only tracker": {
+			tiers: [][]string{{"udp://" + silent.addr()}},
+			peers: nil,
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		tf := TorrentFile{}
+		start := time.Now()
+		resp, err := tf.announce(&trackerTiers{tiers: test.tiers}, announceParams{port: 6881})
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			require.Nil(t, err, name)
+			assert.Equal(t, test.peers, resp.peers, name)
+		}
+		// Much sooner than the first retransmission of the silent tracker
+		assert.True(t, time.Since(start) < udpTimeout, name)
+	}
+}
+
+func TestAnnounceAllTrackersFail(t *testing.T) {
+	dead := newMockTracker(nil)
+	dead.Close()
+
+	tf := TorrentFile{AnnounceList: [][]string{{dead.URL}, {"wss://unsupported"}}}
+	_, err := tf.getPeers([20]byte{}, 6881)
+	assert.NotNil(t, err)
+}
@@ -1,15 +1,22 @@
 package torrentfile
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 
+	"github.com/cedrickchee/min-torrent/bencode"
+	"github.com/cedrickchee/min-torrent/bitfield"
+	"github.com/cedrickchee/min-torrent/listener"
 	"github.com/cedrickchee/min-torrent/p2p"
-	"github.com/jackpal/bencode-go"
+	"github.com/cedrickchee/min-torrent/storage"
 )
 
 // Port to listen on
@@ -17,94 +24,289 @@ const port = 6881
 
 // TorrentFile encodes the metadata from a .torrent file
 type TorrentFile struct {
-	Name        string
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
+	Name         string
+	Announce     string
+	AnnounceList [][]string // tiers of tracker URLs (BEP 12)
+	InfoHash     [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Files        []File // only set for multi-file torrents
+}
+
+// File describes one file of a multi-file torrent
+type File struct {
+	Path   []string // path components, relative to the output directory
+	Length int
+	Offset int // position of the file within the concatenated torrent data
+}
+
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
 type bencodeInfo struct {
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
+	Length      int           `bencode:"length"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Name        string        `bencode:"name"`
+	PieceLength int           `bencode:"piece length"`
+	Pieces      string        `bencode:"pieces"`
+	raw         []byte        // the dictionary exactly as it appears in the file
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list"`
+	Info         bencodeInfo `bencode:"info"`
 }
 
 // Open parses a torrent file.
 func Open(path string) (TorrentFile, error) {
-	file, err := os.Open(path)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	defer file.Close()
 
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(data, &bto)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 	return bto.toTorrentFile()
 }
 
-// DownloadToFile downloads a torrent and writes it to a file
-func (t *TorrentFile) DownloadToFile(path string) error {
-	// A PeerID is a 20 byte unique identifier presented to trackers and peers
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
+// DownloadToFile downloads a torrent and writes it to a file, until it is
+// complete or stop is closed. For multi-file torrents, path is a directory
+// and the files are laid out beneath it following their path components.
+// Pieces already verified by an interrupted download are kept.
+func (t *TorrentFile) DownloadToFile(path string, stop <-chan struct{}) error {
+	have, check := t.loadResume(path)
+	return t.downloadToFile(path, have, check, stop)
+}
+
+// downloadToFile downloads the pieces missing from the files at path, and
+// saves the resume file if it stops before the download is complete
+func (t *TorrentFile) downloadToFile(path string, have bitfield.Bitfield, check bool, stop <-chan struct{}) error {
+	have, err := t.download(storage.NewFile(path), have, check, stop)
+	if err == nil {
+		return removeResume(path)
+	}
+	if have != nil {
+		saveErr := t.saveResume(path, have)
+		if saveErr != nil {
+			log.Printf("Could not save resume file: %v\n", saveErr)
+		}
+	}
+	return err
+}
+
+// Download downloads a torrent into a storage, until it is complete or stop
+// is closed
+func (t *TorrentFile) Download(s storage.Storage, stop <-chan struct{}) error {
+	_, err := t.download(s, nil, false, stop)
+	return err
+}
+
+// download downloads the pieces missing from a storage. Pieces in have are
+// trusted, and if check is set the storage is hash-checked for pieces
+// instead. Returns the pieces verified by the time it stopped, once the
+// storage is closed.
+func (t *TorrentFile) download(s storage.Storage, have bitfield.Bitfield, check bool, stop <-chan struct{}) (bitfield.Bitfield, error) {
+	peerID, err := newPeerID()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	st, err := s.OpenTorrent(t.storageInfo())
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+
+	torrent := &p2p.Torrent{
+		PeerID:      peerID,
+		InfoHash:    t.InfoHash,
+		PieceHashes: t.PieceHashes,
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+		Name:        t.Name,
+		Storage:     st,
+		Have:        have,
+	}
+	if check {
+		log.Println("Checking existing data of", t.Name)
+		torrent.Have = torrent.Verify(runtime.NumCPU())
+	}
+	defer torrent.Close()
+
+	// Accept connections from peers that learn about us from the trackers
+	l, err := listener.Listen(port)
+	if err != nil {
+		log.Printf("Not accepting incoming connections: %v\n", err)
+	} else {
+		go l.Serve()
+		defer l.Close()
+	}
+
+	a := newAnnouncer(t, peerID, port)
+	a.stats = torrent.Stats
+	resp, err := a.start()
+	if err != nil {
+		return torrent.Bitfield(), err
+	}
+
+	log.Printf("Found %d peers", len(resp.peers))
+
+	torrent.Peers = resp.peers
+	a.onPeers = torrent.AddPeers
+	go a.run(resp)
+	defer a.shutdown()
+
+	if l != nil {
+		l.Add(t.InfoHash, torrent)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			torrent.Close()
+		case <-done:
+		}
+	}()
+
+	err = torrent.Download()
+	if err != nil {
+		select {
+		case <-stop:
+			err = errors.New("Download was stopped")
+		default:
+		}
+		return torrent.Bitfield(), err
 	}
+	a.complete()
+	return torrent.Bitfield(), nil
+}
 
-	log.Println("Connecting with tracker", t.Announce)
+// Seed shares the torrent's data, already on disk at path, until stop is
+// closed. The data is hash-checked first. For multi-file torrents, path is
+// the directory the files are laid out beneath.
+func (t *TorrentFile) Seed(path string, stop <-chan struct{}) error {
+	err := t.checkSizes(path)
+	if err != nil {
+		return err
+	}
+	return t.SeedFrom(storage.NewFile(path), stop)
+}
 
-	peers, err := t.getPeers(peerID, port)
+// SeedFrom shares the torrent's data, already in a storage, until stop is
+// closed. The data is hash-checked first.
+func (t *TorrentFile) SeedFrom(s storage.Storage, stop <-chan struct{}) error {
+	peerID, err := newPeerID()
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Found %d peers", len(peers))
+	st, err := s.OpenTorrent(t.storageInfo())
+	if err != nil {
+		return err
+	}
+	defer st.Close()
 
-	torrent := p2p.Torrent{
-		Peers:       peers,
+	torrent := &p2p.Torrent{
 		PeerID:      peerID,
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		Storage:     st,
 	}
-	buf, err := torrent.Download()
+	err = torrent.Seed()
 	if err != nil {
 		return err
 	}
+	defer torrent.Close()
 
-	outFile, err := os.Create(path)
+	l, err := listener.Listen(port)
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
+	l.Add(t.InfoHash, torrent)
+	go l.Serve()
+	defer l.Close()
+
+	a := newAnnouncer(t, peerID, port)
+	a.stats = torrent.Stats
+	resp, err := a.startSeeding()
 	if err != nil {
-		return err
+		log.Println("Will retry announcing later")
 	}
+	go a.run(resp)
+	defer a.shutdown()
+
+	<-stop
 	return nil
 }
 
-func (i *bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
+// newPeerID generates a PeerID, a 20 byte unique identifier presented to
+// trackers and peers
+func newPeerID() ([20]byte, error) {
+	var peerID [20]byte
+	_, err := rand.Read(peerID[:])
+	return peerID, err
+}
+
+// storageInfo describes the torrent's content to a storage
+func (t *TorrentFile) storageInfo() *storage.Info {
+	info := &storage.Info{
+		InfoHash:    t.InfoHash,
+		Name:        t.Name,
+		PieceLength: t.PieceLength,
+		Length:      int64(t.Length),
+	}
+	if len(t.Files) == 0 {
+		info.Files = []storage.FileInfo{{Length: int64(t.Length)}}
+		return info
+	}
+	for _, f := range t.Files {
+		info.Files = append(info.Files, storage.FileInfo{
+			Path:   filepath.Join(f.Path...),
+			Length: int64(f.Length),
+		})
+	}
+	return info
+}
+
+// checkSizes makes sure the files at path have the expected sizes, so
+// that they aren't truncated or extended when opened for seeding
+func (t *TorrentFile) checkSizes(path string) error {
+	for _, f := range t.storageInfo().Files {
+		filePath := filepath.Join(path, f.Path)
+		stat, err := os.Stat(filePath)
+		if err != nil {
+			return err
+		}
+		if stat.Size() != f.Length {
+			return fmt.Errorf("%s has length %d, expected %d", filePath, stat.Size(), f.Length)
+		}
+	}
+	return nil
+}
+
+// UnmarshalBencode decodes the info dictionary and keeps its raw bytes.
+// The info hash must be computed over those exact bytes: re-encoding the
+// decoded struct would drop any keys we don't know about.
+func (i *bencodeInfo) UnmarshalBencode(data []byte) error {
+	type plainInfo bencodeInfo // same fields, without this method
+	err := bencode.Unmarshal(data, (*plainInfo)(i))
 	if err != nil {
-		return [20]byte{}, err
+		return err
 	}
-	hs := sha1.Sum(buf.Bytes())
-	return hs, nil
+	i.raw = append([]byte(nil), data...)
+	return nil
 }
 
 func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
@@ -124,23 +326,68 @@ func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 	return hashes, nil
 }
 
+// files converts the info dictionary's file list, computing each file's
+// offset and the total length of the torrent.
+func (i *bencodeInfo) files() ([]File, int, error) {
+	if len(i.Files) == 0 {
+		return nil, i.Length, nil
+	}
+
+	files := make([]File, len(i.Files))
+	offset := 0
+	for idx, bf := range i.Files {
+		if len(bf.Path) == 0 {
+			return nil, 0, fmt.Errorf("File #%d has an empty path", idx)
+		}
+		for _, component := range bf.Path {
+			if component == "" || component == "." || component == ".." ||
+				strings.ContainsAny(component, "/\\") {
+				return nil, 0, fmt.Errorf("File #%d has an invalid path component %q", idx, component)
+			}
+		}
+		if bf.Length < 0 {
+			return nil, 0, fmt.Errorf("File #%d has a negative length %d", idx, bf.Length)
+		}
+		files[idx] = File{
+			Path:   bf.Path,
+			Length: bf.Length,
+			Offset: offset,
+		}
+		offset += bf.Length
+	}
+	return files, offset, nil
+}
+
 func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
+	if bto.Info.raw == nil {
+		return TorrentFile{}, errors.New("Torrent has no info dictionary")
+	}
+	infoHash := sha1.Sum(bto.Info.raw)
+	pieceHashes, err := bto.Info.splitPieceHashes()
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	pieceHashes, err := bto.Info.splitPieceHashes()
+	files, length, err := bto.Info.files()
 	if err != nil {
 		return TorrentFile{}, err
 	}
+	if bto.Info.PieceLength <= 0 {
+		return TorrentFile{}, fmt.Errorf("Invalid piece length %d", bto.Info.PieceLength)
+	}
+	numPieces := (length + bto.Info.PieceLength - 1) / bto.Info.PieceLength
+	if len(pieceHashes) != numPieces {
+		return TorrentFile{}, fmt.Errorf("Torrent has %d piece hashes, expected %d for its length", len(pieceHashes), numPieces)
+	}
 
 	t := TorrentFile{
-		Name:        bto.Info.Name,
-		Announce:    bto.Announce,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
+		Name:         bto.Info.Name,
+		Announce:     bto.Announce,
+		AnnounceList: bto.AnnounceList,
+		InfoHash:     infoHash,
+		PieceHashes:  pieceHashes,
+		PieceLength:  bto.Info.PieceLength,
+		Length:       length,
+		Files:        files,
 	}
 
 	return t, nil
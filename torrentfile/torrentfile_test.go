@@ -1,11 +1,15 @@
 package torrentfile
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/cedrickchee/min-torrent/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -22,22 +26,23 @@ func TestToTorrentFile(t *testing.T) {
 			input: &bencodeTorrent{
 				Announce: "http://bttracker.debian.org:6969/announce",
 				Info: bencodeInfo{
-					Length:      351272960,
+					Length:      262244,
 					Name:        "debian-10.2.0-amd64-netinst.iso",
 					PieceLength: 262144,
 					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
+					raw:         []byte("d6:lengthi262244e4:name31:debian-10.2.0-amd64-netinst.iso12:piece lengthi262144e6:pieces40:1234567890abcdefghijabcdefghij1234567890e"),
 				},
 			},
 			output: TorrentFile{
 				Name:     "debian-10.2.0-amd64-netinst.iso",
 				Announce: "http://bttracker.debian.org:6969/announce",
-				InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+				InfoHash: [20]byte{32, 193, 77, 241, 109, 71, 83, 114, 100, 5, 103, 197, 83, 215, 214, 155, 121, 206, 86, 70},
 				PieceHashes: [][20]byte{
 					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
 					{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
 				},
 				PieceLength: 262144,
-				Length:      351272960,
+				Length:      262244,
 			},
 			fails: false,
 		},
@@ -49,11 +54,58 @@ func TestToTorrentFile(t *testing.T) {
 					Name:        "debian-10.2.0-amd64-netinst.iso",
 					PieceLength: 262144,
 					Pieces:      "1234567890abcdefghijabcdef", // Only 26 bytes
+					raw:         []byte("d6:lengthi351272960e4:name31:debian-10.2.0-amd64-netinst.iso12:piece lengthi262144e6:pieces26:1234567890abcdefghijabcdefe"),
 				},
 			},
 			output: TorrentFile{},
 			fails:  true,
 		},
+		"zero piece length": {
+			input: &bencodeTorrent{
+				Info: bencodeInfo{
+					Length:      5,
+					Name:        "a.txt",
+					PieceLength: 0,
+					Pieces:      "1234567890abcdefghij",
+					raw:         []byte("d6:lengthi5e4:name5:a.txt12:piece lengthi0e6:pieces20:1234567890abcdefghije"),
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
+		"too few pieces": {
+			input: &bencodeTorrent{
+				Info: bencodeInfo{
+					Length:      351272960,
+					Name:        "debian-10.2.0-amd64-netinst.iso",
+					PieceLength: 262144,
+					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
+					raw:         []byte("d6:lengthi351272960e4:name31:debian-10.2.0-amd64-netinst.iso12:piece lengthi262144e6:pieces40:1234567890abcdefghijabcdefghij1234567890e"),
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
+		"too many pieces": {
+			input: &bencodeTorrent{
+				Info: bencodeInfo{
+					Length:      262144,
+					Name:        "debian-10.2.0-amd64-netinst.iso",
+					PieceLength: 262144,
+					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
+					raw:         []byte("d6:lengthi262144e4:name31:debian-10.2.0-amd64-netinst.iso12:piece lengthi262144e6:pieces40:1234567890abcdefghijabcdefghij1234567890e"),
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
+		"no info dictionary": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
 	}
 
 	for _, test := range tests {
@@ -86,3 +138,143 @@ func TestOpen(t *testing.T) {
 
 	assert.Equal(t, expected, torrent)
 }
+
+func TestOpenHashesRawInfo(t *testing.T) {
+	// The info dictionary carries keys that bencodeInfo doesn't know about.
+	// They must still be part of the info hash.
+	info := "d" +
+		"6:lengthi5e" +
+		"6:md5sum32:0123456789abcdef0123456789abcdef" +
+		"4:name5:a.txt" +
+		"12:piece lengthi16384e" +
+		"6:pieces20:aaaaaaaaaaaaaaaaaaaa" +
+		"7:privatei1e" +
+		"6:source3:xyz" +
+		"e"
+	data := "d" +
+		"8:announce" + "25:http://tracker.test/annnc" +
+		"7:comment" + "12:l1:xe i-1e d" + // looks like bencode, but is a string
+		"4:info" + info +
+		"3:zzz" + "li1ee" +
+		"e"
+
+	f, err := ioutil.TempFile("", "min-torrent-*.torrent")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(data)
+	require.Nil(t, err)
+	f.Close()
+
+	torrent, err := Open(f.Name())
+	require.Nil(t, err)
+	assert.Equal(t, sha1.Sum([]byte(info)), torrent.InfoHash)
+	assert.Equal(t, 5, torrent.Length)
+}
+
+func TestFiles(t *testing.T) {
+	tests := map[string]struct {
+		input  bencodeInfo
+		files  []File
+		length int
+		fails  bool
+	}{
+		"single file": {
+			input:  bencodeInfo{Length: 1024, Name: "debian.iso"},
+			files:  nil,
+			length: 1024,
+			fails:  false,
+		},
+		"multiple files": {
+			input: bencodeInfo{
+				Name: "album",
+				Files: []bencodeFile{
+					{Length: 100, Path: []string{"cover.jpg"}},
+					{Length: 250, Path: []string{"disc1", "track01.mp3"}},
+					{Length: 50, Path: []string{"disc1", "track02.mp3"}},
+				},
+			},
+			files: []File{
+				{Path: []string{"cover.jpg"}, Length: 100, Offset: 0},
+				{Path: []string{"disc1", "track01.mp3"}, Length: 250, Offset: 100},
+				{Path: []string{"disc1", "track02.mp3"}, Length: 50, Offset: 350},
+			},
+			length: 400,
+			fails:  false,
+		},
+		"path escapes output directory": {
+			input: bencodeInfo{
+				Name:  "album",
+				Files: []bencodeFile{{Length: 100, Path: []string{"..", "passwd"}}},
+			},
+			fails: true,
+		},
+		"empty path": {
+			input: bencodeInfo{
+				Name:  "album",
+				Files: []bencodeFile{{Length: 100, Path: []string{}}},
+			},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		files, length, err := test.input.files()
+		if test.fails {
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, test.files, files)
+		assert.Equal(t, test.length, length)
+	}
+}
+
+func TestStorageInfo(t *testing.T) {
+	tests := map[string]struct {
+		input  TorrentFile
+		output []storage.FileInfo
+	}{
+		"single file": {
+			input:  TorrentFile{Length: 10},
+			output: []storage.FileInfo{{Path: "", Length: 10}},
+		},
+		"multiple files": {
+			input: TorrentFile{
+				Length: 10,
+				Files: []File{
+					{Path: []string{"a.txt"}, Length: 3, Offset: 0},
+					{Path: []string{"sub", "b.txt"}, Length: 7, Offset: 3},
+				},
+			},
+			output: []storage.FileInfo{
+				{Path: "a.txt", Length: 3},
+				{Path: filepath.Join("sub", "b.txt"), Length: 7},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		info := test.input.storageInfo()
+		assert.Equal(t, test.output, info.Files, name)
+		assert.Equal(t, int64(10), info.Length, name)
+	}
+}
+
+func TestCheckSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "min-torrent")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.txt")
+	err = ioutil.WriteFile(path, []byte("abc"), 0644)
+	require.Nil(t, err)
+
+	assert.Nil(t, (&TorrentFile{Length: 3}).checkSizes(path))
+	assert.NotNil(t, (&TorrentFile{Length: 4}).checkSizes(path))
+	assert.NotNil(t, (&TorrentFile{Length: 3}).checkSizes(filepath.Join(dir, "missing")))
+
+	multi := TorrentFile{
+		Length: 3,
+		Files:  []File{{Path: []string{"a.txt"}, Length: 3}},
+	}
+	assert.Nil(t, multi.checkSizes(dir))
+}
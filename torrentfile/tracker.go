@@ -1,28 +1,125 @@
 package torrentfile
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
 
+	"github.com/cedrickchee/min-torrent/bencode"
 	"github.com/cedrickchee/min-torrent/peers"
-	"github.com/jackpal/bencode-go"
 )
 
+// Announce events
+const (
+	eventNone      = ""
+	eventStarted   = "started"
+	eventCompleted = "completed"
+	eventStopped   = "stopped"
+)
+
+// TrackerError is returned when a tracker refuses an announce
+type TrackerError struct {
+	Tracker string
+	Reason  string // the tracker's failure reason
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("Tracker %s failed: %s", e.Tracker, e.Reason)
+}
+
 // TrackerResponse
 type bencodeTrackerResponse struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason  string             `bencode:"failure reason"`
+	WarningMessage string             `bencode:"warning message"`
+	Interval       int                `bencode:"interval"`
+	MinInterval    int                `bencode:"min interval"`
+	TrackerID      string             `bencode:"tracker id"`
+	Complete       int                `bencode:"complete"`
+	Incomplete     int                `bencode:"incomplete"`
+	Peers          bencode.RawMessage `bencode:"peers"`  // compact string or list of dictionaries
+	Peers6         string             `bencode:"peers6"` // compact IPv6 peers (BEP 7)
+}
+
+// bencodePeer is an entry of the non-compact peer list
+type bencodePeer struct {
+	PeerID string `bencode:"peer id"`
+	IP     string `bencode:"ip"` // IPv4, IPv6 or DNS name
+	Port   int    `bencode:"port"`
 }
 
+// announceParams are the values reported to a tracker with an announce
+type announceParams struct {
+	peerID     [20]byte
+	port       uint16
+	uploaded   int64
+	downloaded int64
+	left       int64
+	event      string
+	trackerID  string // echoed back if the tracker gave us one
+	ipv6       net.IP // our global IPv6 address, if we have one
+}
+
+// trackerResponse is what a tracker told us in answer to an announce
+type trackerResponse struct {
+	interval    time.Duration // how long to wait before announcing again
+	minInterval time.Duration // announcing sooner than this is not allowed
+	peers       []peers.Peer
+	trackerID   string
+	warning     string
+	seeders     int
+	leechers    int
+}
+
+// getPeers announces to the torrent's trackers and returns the peers
+// they know about
 func (t *TorrentFile) getPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	url, err := t.buildTrackerURL(peerID, port)
+	params := announceParams{
+		peerID: peerID,
+		port:   port,
+		left:   int64(t.Length),
+		ipv6:   localIPv6(),
+	}
+	resp, err := t.announce(newTrackerTiers(t), params)
+	if err != nil {
+		return nil, err
+	}
+	return resp.peers, nil
+}
+
+// httpTimeout is how long an HTTP tracker may take to respond
+const httpTimeout = 30 * time.Second
+
+// announceTo announces to a single tracker, choosing the protocol by the
+// announce URL's scheme. timeout bounds the whole announce, retransmissions
+// included.
+func (t *TorrentFile) announceTo(announce string, params announceParams, timeout time.Duration) (*trackerResponse, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if timeout > httpTimeout {
+			timeout = httpTimeout
+		}
+		return t.announceHTTP(announce, params, timeout)
+	case "udp":
+		return t.announceUDP(u.Host, params, time.Now().Add(timeout))
+	default:
+		return nil, fmt.Errorf("Unsupported tracker protocol %q", u.Scheme)
+	}
+}
+
+func (t *TorrentFile) announceHTTP(announce string, params announceParams, timeout time.Duration) (*trackerResponse, error) {
+	url, err := t.buildTrackerURL(announce, params)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
+	client := &http.Client{Timeout: timeout}
 	resp, err := client.Get(url)
 	if err != nil {
 		return nil, err
@@ -30,30 +127,153 @@ func (t *TorrentFile) getPeers(peerID [20]byte, port uint16) ([]peers.Peer, erro
 	defer resp.Body.Close()
 
 	trackerResp := bencodeTrackerResponse{}
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
+	err = bencode.NewDecoder(resp.Body).Decode(&trackerResp)
 	if err != nil {
 		return nil, err
 	}
+	if trackerResp.FailureReason != "" {
+		return nil, &TrackerError{Tracker: announce, Reason: trackerResp.FailureReason}
+	}
 
-	return peers.Unmarshal([]byte(trackerResp.Peers))
+	peerList, err := unmarshalPeers(trackerResp.Peers)
+	if err != nil {
+		return nil, err
+	}
+	peers6, err := peers.Unmarshal6([]byte(trackerResp.Peers6))
+	if err != nil {
+		return nil, err
+	}
+	peerList = append(peerList, peers6...)
+	return &trackerResponse{
+		interval:    time.Duration(trackerResp.Interval) * time.Second,
+		minInterval: time.Duration(trackerResp.MinInterval) * time.Second,
+		peers:       peerList,
+		trackerID:   trackerResp.TrackerID,
+		warning:     trackerResp.WarningMessage,
+		seeders:     trackerResp.Complete,
+		leechers:    trackerResp.Incomplete,
+	}, nil
 }
 
-func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
-	base, err := url.Parse(t.Announce)
+// unmarshalPeers parses the peers of an HTTP tracker response, which come
+// either as a compact string or as a list of dictionaries
+func unmarshalPeers(raw bencode.RawMessage) ([]peers.Peer, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if raw[0] != 'l' {
+		var compact string
+		err := bencode.Unmarshal(raw, &compact)
+		if err != nil {
+			return nil, err
+		}
+		return peers.Unmarshal([]byte(compact))
+	}
+
+	var list []bencodePeer
+	err := bencode.Unmarshal(raw, &list)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(list))
+	for _, p := range list {
+		addrs = append(addrs, net.JoinHostPort(p.IP, strconv.Itoa(p.Port)))
+	}
+	return resolvePeers(addrs), nil
+}
+
+func (t *TorrentFile) announceUDP(addr string, params announceParams, deadline time.Time) (*trackerResponse, error) {
+	tracker, err := dialUDPTracker(addr, deadline)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+
+	resp, err := tracker.announce(t.InfoHash, params)
+	if err != nil {
+		return nil, err
+	}
+	return &trackerResponse{
+		interval: time.Duration(resp.interval) * time.Second,
+		peers:    resp.peers,
+		seeders:  resp.seeders,
+		leechers: resp.leechers,
+	}, nil
+}
+
+func (t *TorrentFile) buildTrackerURL(announce string, params announceParams) (string, error) {
+	base, err := url.Parse(announce)
 	if err != nil {
 		return "", err
 	}
 
-	params := url.Values{
+	query := url.Values{
 		"info_hash":  []string{string(t.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"peer_id":    []string{string(params.peerID[:])},
+		"port":       []string{strconv.Itoa(int(params.port))},
+		"uploaded":   []string{strconv.FormatInt(params.uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(params.downloaded, 10)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.Length)},
+		"left":       []string{strconv.FormatInt(params.left, 10)},
+	}
+	if params.event != eventNone {
+		query.Set("event", params.event)
+	}
+	if params.trackerID != "" {
+		query.Set("trackerid", params.trackerID)
 	}
-	base.RawQuery = params.Encode()
+	if params.ipv6 != nil {
+		query.Set("ipv6", params.ipv6.String())
+	}
+	base.RawQuery = query.Encode()
 
 	return base.String(), nil
 }
+
+// resolvePeers turns host:port addresses into peers, skipping bad ones
+func resolvePeers(addrs []string) []peers.Peer {
+	var resolved []peers.Peer
+	for _, addr := range addrs {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			continue
+		}
+		resolved = append(resolved, peers.Peer{IP: ips[0], Port: uint16(port)})
+	}
+	return resolved
+}
+
+// localIPv6 returns a global unicast IPv6 address of this host, so trackers
+// can hand it out to IPv6 peers even when we announce over IPv4 (BEP 7).
+// Returns nil if the host has none.
+func localIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		if ip.To4() == nil && ip.IsGlobalUnicast() && !isUniqueLocal(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// isUniqueLocal reports whether ip is in fc00::/7, which is not routable
+// on the internet
+func isUniqueLocal(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
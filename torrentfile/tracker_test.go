@@ -4,10 +4,13 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/cedrickchee/min-torrent/peers"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBuildTrackerURL(t *testing.T) {
@@ -24,12 +27,44 @@ func TestBuildTrackerURL(t *testing.T) {
 	}
 	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 	const port uint16 = 6882
-	url, err := to.buildTrackerURL(peerID, port)
+	params := announceParams{peerID: peerID, port: port, left: int64(to.Length)}
+	url, err := to.buildTrackerURL(to.Announce, params)
 	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6882&uploaded=0"
 	assert.Nil(t, err)
 	assert.Equal(t, expected, url)
 }
 
+func TestBuildTrackerURLWithEvent(t *testing.T) {
+	to := TorrentFile{
+		Announce: "http://bttracker.debian.org:6969/announce",
+		InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+	}
+	params := announceParams{
+		port:       6881,
+		uploaded:   1024,
+		downloaded: 2048,
+		left:       4096,
+		event:      eventCompleted,
+	}
+	u, err := to.buildTrackerURL(to.Announce, params)
+	assert.Nil(t, err)
+	parsed, err := url.Parse(u)
+	assert.Nil(t, err)
+	query := parsed.Query()
+	assert.Equal(t, "1024", query.Get("uploaded"))
+	assert.Equal(t, "2048", query.Get("downloaded"))
+	assert.Equal(t, "4096", query.Get("left"))
+	assert.Equal(t, "completed", query.Get("event"))
+	assert.Equal(t, "", query.Get("ipv6"))
+
+	params.ipv6 = net.ParseIP("2001:db8::1")
+	u, err = to.buildTrackerURL(to.Announce, params)
+	assert.Nil(t, err)
+	parsed, err = url.Parse(u)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", parsed.Query().Get("ipv6"))
+}
+
 func TestGetPeers(t *testing.T) {
 	// Mock tracker server
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -69,3 +104,111 @@ func TestGetPeers(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, p)
 }
+
+func TestResolvePeers(t *testing.T) {
+	resolved := resolvePeers([]string{"10.0.0.1:6881", "[::1]:6882", "no-port", "10.0.0.2:99999"})
+	expected := []peers.Peer{
+		{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+		{IP: net.ParseIP("::1"), Port: 6882},
+	}
+	assert.Equal(t, expected, resolved)
+}
+
+func TestAnnounceHTTPResponses(t *testing.T) {
+	tests := map[string]struct {
+		response string
+		output   *trackerResponse
+		fails    bool
+		refused  bool // the error is a *TrackerError
+	}{
+		"failure reason": {
+			response: "d14:failure reason17:torrent not founde",
+			output:   nil,
+			fails:    true,
+			refused:  true,
+		},
+		"warning, tracker id and swarm counts": {
+			response: "d8:completei5e10:incompletei3e8:intervali900e5:peers0:10:tracker id3:abc15:warning message9:slow downe",
+			output: &trackerResponse{
+				interval:  900 * time.Second,
+				peers:     []peers.Peer{},
+				trackerID: "abc",
+				warning:   "slow down",
+				seeders:   5,
+				leechers:  3,
+			},
+			fails: false,
+		},
+		"IPv4 and IPv6 peers": {
+			response: "d8:intervali900e5:peers6:" +
+				string([]byte{10, 0, 1, 8, 0x1B, 0x50}) +
+				"6:peers618:" +
+				string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1B, 0x51}) +
+				"e",
+			output: &trackerResponse{
+				interval: 900 * time.Second,
+				peers: []peers.Peer{
+					{IP: net.IP{10, 0, 1, 8}, Port: 6992},
+					{IP: net.ParseIP("2001:db8::1"), Port: 6993},
+				},
+			},
+			fails: false,
+		},
+		"malformed peers6": {
+			response: "d8:intervali900e5:peers0:6:peers63:abce",
+			output:   nil,
+			fails:    true,
+		},
+		"dictionary peers": {
+			response: "d8:intervali900e5:peersl" +
+				"d2:ip8:10.0.1.87:peer id20:-TR2940-k8hj0wgej6ch4:porti6992ee" +
+				"d2:ip9:127.0.0.14:porti6993ee" +
+				"d2:ip3:::14:porti6994ee" +
+				"ee",
+			output: &trackerResponse{
+				interval: 900 * time.Second,
+				peers: []peers.Peer{
+					{IP: net.ParseIP("10.0.1.8"), Port: 6992},
+					{IP: net.ParseIP("127.0.0.1"), Port: 6993},
+					{IP: net.ParseIP("::1"), Port: 6994},
+				},
+			},
+			fails: false,
+		},
+	}
+
+	for name, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(test.response))
+		}))
+		tf := TorrentFile{Announce: ts.URL}
+		resp, err := tf.announceTo(ts.URL, announceParams{port: 6881}, announceTimeout)
+		ts.Close()
+
+		if test.fails {
+			assert.NotNil(t, err, name)
+			_, ok := err.(*TrackerError)
+			assert.Equal(t, test.refused, ok, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, resp, name)
+	}
+}
+
+func TestTrackerIDIsEchoed(t *testing.T) {
+	var trackerIDs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trackerIDs = append(trackerIDs, r.URL.Query().Get("trackerid"))
+		w.Write([]byte("d8:intervali900e5:peers0:10:tracker id3:abce"))
+	}))
+	defer ts.Close()
+
+	tf := TorrentFile{Announce: ts.URL}
+	tiers := newTrackerTiers(&tf)
+	_, err := tf.announce(tiers, announceParams{port: 6881})
+	require.Nil(t, err)
+	_, err = tf.announce(tiers, announceParams{port: 6881})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"", "abc"}, trackerIDs)
+}
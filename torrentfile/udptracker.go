@@ -0,0 +1,291 @@
+package torrentfile
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/peers"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolID = 0x41727101980 // magic constant sent with connect requests
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+)
+
+// udpConnIDLifetime is how long a client may keep using a connection ID
+const udpConnIDLifetime = time.Minute
+
+// Retransmission schedule: wait 15 * 2^n seconds for a response, with n
+// going from 0 up to 8. These are variables so tests can shorten them.
+var (
+	udpTimeout    = 15 * time.Second
+	udpMaxRetries = 8
+)
+
+type udpConnID struct {
+	id       uint64
+	obtained time.Time
+}
+
+// Connection IDs are cached per tracker address so that repeated
+// announces don't need a connect round trip each time
+var udpConnIDs = struct {
+	sync.Mutex
+	m map[string]udpConnID
+}{m: map[string]udpConnID{}}
+
+type udpAnnounceResponse struct {
+	interval int
+	leechers int
+	seeders  int
+	peers    []peers.Peer
+}
+
+type udpScrapeResponse struct {
+	seeders   int
+	completed int
+	leechers  int
+}
+
+// udpTracker runs transactions against a single UDP tracker
+type udpTracker struct {
+	addr     string
+	conn     net.Conn
+	deadline time.Time // transactions give up past it, unless zero
+}
+
+// dialUDPTracker prepares transactions with the tracker at addr. If
+// deadline isn't zero, retransmissions stop there rather than running
+// through the whole schedule.
+func dialUDPTracker(addr string, deadline time.Time) (*udpTracker, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTracker{addr: addr, conn: conn, deadline: deadline}, nil
+}
+
+func (u *udpTracker) Close() error {
+	return u.conn.Close()
+}
+
+// udpEvents maps announce events to their code in the UDP protocol
+var udpEvents = map[string]uint32{
+	eventNone:      0,
+	eventCompleted: 1,
+	eventStarted:   2,
+	eventStopped:   3,
+}
+
+// announce asks the tracker for peers
+func (u *udpTracker) announce(infoHash [20]byte, params announceParams) (*udpAnnounceResponse, error) {
+	key := make([]byte, 4)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, 82)
+	copy(body[0:20], infoHash[:])
+	copy(body[20:40], params.peerID[:])
+	binary.BigEndian.PutUint64(body[40:48], uint64(params.downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(params.left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(params.uploaded))
+	binary.BigEndian.PutUint32(body[64:68], udpEvents[params.event])
+	binary.BigEndian.PutUint32(body[68:72], 0) // IP address: use the sender's
+	copy(body[72:76], key)
+	binary.BigEndian.PutUint32(body[76:80], 0xFFFFFFFF) // num_want: default
+	binary.BigEndian.PutUint16(body[80:82], params.port)
+
+	resp, err := u.request(udpActionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, fmt.Errorf("Announce response too short. %d < 12", len(resp))
+	}
+	// Trackers reached over IPv6 answer with 18 byte IPv6 entries (BEP 15)
+	unmarshal := peers.Unmarshal
+	if u.isIPv6() {
+		unmarshal = peers.Unmarshal6
+	}
+	peerList, err := unmarshal(resp[12:])
+	if err != nil {
+		return nil, err
+	}
+	return &udpAnnounceResponse{
+		interval: int(binary.BigEndian.Uint32(resp[0:4])),
+		leechers: int(binary.BigEndian.Uint32(resp[4:8])),
+		seeders:  int(binary.BigEndian.Uint32(resp[8:12])),
+		peers:    peerList,
+	}, nil
+}
+
+// isIPv6 reports whether the tracker is reached over IPv6
+func (u *udpTracker) isIPv6() bool {
+	addr, ok := u.conn.RemoteAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil
+}
+
+// scrape asks the tracker for swarm statistics of each info hash
+func (u *udpTracker) scrape(infoHashes [][20]byte) ([]udpScrapeResponse, error) {
+	body := make([]byte, 0, 20*len(infoHashes))
+	for _, infoHash := range infoHashes {
+		body = append(body, infoHash[:]...)
+	}
+
+	resp, err := u.request(udpActionScrape, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != 12*len(infoHashes) {
+		return nil, fmt.Errorf("Scrape response has length %d, expected %d", len(resp), 12*len(infoHashes))
+	}
+	stats := make([]udpScrapeResponse, len(infoHashes))
+	for i := range stats {
+		entry := resp[i*12 : (i+1)*12]
+		stats[i] = udpScrapeResponse{
+			seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+			completed: int(binary.BigEndian.Uint32(entry[4:8])),
+			leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+		}
+	}
+	return stats, nil
+}
+
+// request performs a transaction, retransmitting on the BEP 15 schedule
+// until the tracker's deadline.
+// A fresh connection ID is obtained whenever the cached one has expired.
+// Returns the response payload following the action and transaction ID.
+func (u *udpTracker) request(action uint32, body []byte) ([]byte, error) {
+	var lastErr error
+	for n := 0; n <= udpMaxRetries; n++ {
+		timeout := udpTimeout * time.Duration(1<<uint(n))
+		if !u.deadline.IsZero() {
+			left := time.Until(u.deadline)
+			if left <= 0 {
+				break
+			}
+			if timeout > left {
+				timeout = left
+			}
+		}
+
+		connID, err := u.connectionID(timeout)
+		if err != nil {
+			if isTimeout(err) {
+				lastErr = err
+				continue
+			}
+			return nil, err
+		}
+
+		resp, err := u.exchange(connID, action, body, timeout)
+		if err != nil {
+			if isTimeout(err) {
+				lastErr = err
+				continue
+			}
+			return nil, err
+		}
+		return resp, nil
+	}
+	if lastErr == nil {
+		return nil, fmt.Errorf("Tracker %s did not respond in time", u.addr)
+	}
+	return nil, fmt.Errorf("Tracker %s did not respond: %v", u.addr, lastErr)
+}
+
+// connectionID returns a cached connection ID, or runs a single connect
+// exchange to get a new one
+func (u *udpTracker) connectionID(timeout time.Duration) (uint64, error) {
+	udpConnIDs.Lock()
+	cached, ok := udpConnIDs.m[u.addr]
+	udpConnIDs.Unlock()
+	if ok && time.Since(cached.obtained) < udpConnIDLifetime {
+		return cached.id, nil
+	}
+
+	resp, err := u.exchange(udpProtocolID, udpActionConnect, nil, timeout)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 8 {
+		return 0, fmt.Errorf("Connect response too short. %d < 8", len(resp))
+	}
+	id := binary.BigEndian.Uint64(resp[0:8])
+
+	udpConnIDs.Lock()
+	udpConnIDs.m[u.addr] = udpConnID{id: id, obtained: time.Now()}
+	udpConnIDs.Unlock()
+	return id, nil
+}
+
+// exchange sends one request and waits up to timeout for the response
+// carrying the same transaction ID
+func (u *udpTracker) exchange(connID uint64, action uint32, body []byte, timeout time.Duration) ([]byte, error) {
+	txID := make([]byte, 4)
+	_, err := rand.Read(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	req := make([]byte, 16+len(body))
+	binary.BigEndian.PutUint64(req[0:8], connID)
+	binary.BigEndian.PutUint32(req[8:12], action)
+	copy(req[12:16], txID)
+	copy(req[16:], body)
+
+	_, err = u.conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	u.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer u.conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 4096)
+	for {
+		n, err := u.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || string(buf[4:8]) != string(txID) {
+			continue // stale response to an earlier retransmission
+		}
+
+		respAction := binary.BigEndian.Uint32(buf[0:4])
+		payload := append([]byte(nil), buf[8:n]...)
+		if respAction == udpActionError {
+			if action != udpActionConnect {
+				forgetConnectionID(u.addr)
+			}
+			return nil, &TrackerError{Tracker: "udp://" + u.addr, Reason: string(payload)}
+		}
+		if respAction != action {
+			return nil, fmt.Errorf("Expected action %d, got %d", action, respAction)
+		}
+		return payload, nil
+	}
+}
+
+// forgetConnectionID drops a connection ID the tracker may have rejected
+func forgetConnectionID(addr string) {
+	udpConnIDs.Lock()
+	delete(udpConnIDs.m, addr)
+	udpConnIDs.Unlock()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
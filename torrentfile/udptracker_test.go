@@ -0,0 +1,212 @@
+package torrentfile
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/min-torrent/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockUDPTracker is a stand-in BEP 15 tracker on a local UDP socket
+type mockUDPTracker struct {
+	conn     *net.UDPConn
+	peers    []byte
+	mu       sync.Mutex
+	connects int
+	dropNext int // number of upcoming requests to ignore
+	requests [][]byte
+}
+
+const mockConnID = 0x1122334455667788
+
+func newMockUDPTracker(t *testing.T, peersBin []byte) *mockUDPTracker {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.Nil(t, err)
+	return startMockUDPTracker(conn, peersBin)
+}
+
+func startMockUDPTracker(conn *net.UDPConn, peersBin []byte) *mockUDPTracker {
+	m := &mockUDPTracker{conn: conn, peers: peersBin}
+	go m.serve()
+	return m
+}
+
+func (m *mockUDPTracker) addr() string {
+	return m.conn.LocalAddr().String()
+}
+
+func (m *mockUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+
+		m.mu.Lock()
+		m.requests = append(m.requests, req)
+		drop := m.dropNext > 0
+		if drop {
+			m.dropNext--
+		}
+		m.mu.Unlock()
+		if drop || n < 16 {
+			continue
+		}
+
+		connID := binary.BigEndian.Uint64(req[0:8])
+		action := binary.BigEndian.Uint32(req[8:12])
+		resp := make([]byte, 8)
+		binary.BigEndian.PutUint32(resp[0:4], action)
+		copy(resp[4:8], req[12:16])
+
+		switch {
+		case action == udpActionConnect && connID == udpProtocolID:
+			m.mu.Lock()
+			m.connects++
+			m.mu.Unlock()
+			id := make([]byte, 8)
+			binary.BigEndian.PutUint64(id, mockConnID)
+			resp = append(resp, id...)
+		case connID != mockConnID:
+			binary.BigEndian.PutUint32(resp[0:4], udpActionError)
+			resp = append(resp, "bad connection id"...)
+		case action == udpActionAnnounce:
+			stats := make([]byte, 12)
+			binary.BigEndian.PutUint32(stats[0:4], 1800) // interval
+			binary.BigEndian.PutUint32(stats[4:8], 3)    // leechers
+			binary.BigEndian.PutUint32(stats[8:12], 7)   // seeders
+			resp = append(resp, stats...)
+			resp = append(resp, m.peers...)
+		case action == udpActionScrape:
+			for i := 16; i+20 <= n; i += 20 {
+				stats := make([]byte, 12)
+				binary.BigEndian.PutUint32(stats[0:4], 7)  // seeders
+				binary.BigEndian.PutUint32(stats[4:8], 42) // completed
+				binary.BigEndian.PutUint32(stats[8:12], 3) // leechers
+				resp = append(resp, stats...)
+			}
+		}
+		m.conn.WriteToUDP(resp, from)
+	}
+}
+
+func (m *mockUDPTracker) drop(n int) {
+	m.mu.Lock()
+	m.dropNext = n
+	m.mu.Unlock()
+}
+
+// received returns the requests seen so far and how many were connects
+func (m *mockUDPTracker) received() ([][]byte, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([][]byte(nil), m.requests...), m.connects
+}
+
+func (m *mockUDPTracker) Close() {
+	m.conn.Close()
+	forgetConnectionID(m.addr())
+}
+
+func TestGetPeersUDP(t *testing.T) {
+	tracker := newMockUDPTracker(t, []byte{
+		10, 0, 1, 8, 0x1B, 0x50, // 0x1B50 = 6992
+		127, 0, 0, 1, 0x1B, 0x51, // 0x1B51 = 6993
+	})
+	defer tracker.Close()
+
+	tf := TorrentFile{
+		Announce: "udp://" + tracker.addr() + "/announce",
+		InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+		Length:   351272960,
+	}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	expected := []peers.Peer{
+		{IP: net.IP{10, 0, 1, 8}, Port: 6992},
+		{IP: net.IP{127, 0, 0, 1}, Port: 6993},
+	}
+
+	p, err := tf.getPeers(peerID, 6882)
+	require.Nil(t, err)
+	assert.Equal(t, expected, p)
+
+	// The second announce reuses the cached connection ID
+	p, err = tf.getPeers(peerID, 6882)
+	require.Nil(t, err)
+	assert.Equal(t, expected, p)
+	requests, connects := tracker.received()
+	assert.Equal(t, 1, connects)
+
+	announce := requests[1]
+	assert.Equal(t, tf.InfoHash[:], announce[16:36])
+	assert.Equal(t, peerID[:], announce[36:56])
+	assert.Equal(t, uint64(351272960), binary.BigEndian.Uint64(announce[64:72]))
+	assert.Equal(t, uint16(6882), binary.BigEndian.Uint16(announce[96:98]))
+}
+
+func TestGetPeersUDPOverIPv6(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("IPv6 loopback not available")
+	}
+	tracker := startMockUDPTracker(conn, []byte{
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1B, 0x50,
+	})
+	defer tracker.Close()
+
+	tf := TorrentFile{Announce: "udp://" + tracker.addr() + "/announce"}
+	p, err := tf.getPeers([20]byte{}, 6882)
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.ParseIP("2001:db8::1"), Port: 6992}}, p)
+}
+
+func TestUDPTrackerRetransmits(t *testing.T) {
+	defer func(timeout time.Duration) { udpTimeout = timeout }(udpTimeout)
+	udpTimeout = 20 * time.Millisecond
+
+	tracker := newMockUDPTracker(t, nil)
+	defer tracker.Close()
+	tracker.drop(2) // lose the first connect and its retransmission
+
+	u, err := dialUDPTracker(tracker.addr(), time.Time{})
+	require.Nil(t, err)
+	defer u.Close()
+
+	stats, err := u.scrape([][20]byte{{1}, {2}})
+	require.Nil(t, err)
+	assert.Equal(t, []udpScrapeResponse{
+		{seeders: 7, completed: 42, leechers: 3},
+		{seeders: 7, completed: 42, leechers: 3},
+	}, stats)
+	requests, _ := tracker.received()
+	assert.Len(t, requests, 4) // 3 connects and a scrape
+}
+
+func TestUDPTrackerGivesUp(t *testing.T) {
+	defer func(timeout time.Duration, retries int) {
+		udpTimeout = timeout
+		udpMaxRetries = retries
+	}(udpTimeout, udpMaxRetries)
+	udpTimeout = 10 * time.Millisecond
+	udpMaxRetries = 2
+
+	tracker := newMockUDPTracker(t, nil)
+	defer tracker.Close()
+	tracker.drop(100)
+
+	u, err := dialUDPTracker(tracker.addr(), time.Time{})
+	require.Nil(t, err)
+	defer u.Close()
+
+	_, err = u.announce([20]byte{}, announceParams{port: 6881})
+	assert.NotNil(t, err)
+	requests, _ := tracker.received()
+	assert.Len(t, requests, 3)
+}
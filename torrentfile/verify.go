@@ -0,0 +1,131 @@
+package torrentfile
+
+import (
+	"github.com/cedrickchee/min-torrent/bitfield"
+	"github.com/cedrickchee/min-torrent/p2p"
+	"github.com/cedrickchee/min-torrent/storage"
+)
+
+// VerifyReport tells which parts of a torrent's data on disk are damaged
+type VerifyReport struct {
+	Pieces  int          // number of pieces checked
+	Missing []int        // pieces whose data isn't all on disk
+	Corrupt []int        // pieces that fail the hash check
+	Files   []FileReport // files that are missing, have the wrong size or hold bad pieces
+	have    bitfield.Bitfield
+}
+
+// FileReport describes a damaged file
+type FileReport struct {
+	Path      string // relative to the data path; empty for single-file torrents
+	Missing   bool   // the file doesn't exist
+	Size      int64  // size on disk
+	Length    int64  // expected size
+	BadPieces []int  // missing or corrupt pieces that the file holds part of
+}
+
+// OK tells if every piece is intact
+func (r *VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+// Verify hash-checks the torrent's data on disk at path, on the given number
+// of goroutines. Nothing is written, and no peer or tracker is contacted.
+func (t *TorrentFile) Verify(path string, workers int) (*VerifyReport, error) {
+	files, _, err := t.statFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info := t.storageInfo()
+	st, err := storage.NewFileReadOnly(path).OpenTorrent(info)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+
+	torrent := &p2p.Torrent{
+		InfoHash:    t.InfoHash,
+		PieceHashes: t.PieceHashes,
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+		Name:        t.Name,
+		Storage:     st,
+	}
+	report := &VerifyReport{
+		Pieces: len(t.PieceHashes),
+		have:   torrent.Verify(workers),
+	}
+
+	// A bad piece is missing rather than corrupt if part of it lies past
+	// the end of a file on disk
+	missing := make(map[int]bool)
+	var offset int64
+	for i, f := range info.Files {
+		onDisk := files[i].Length
+		if onDisk < 0 {
+			onDisk = 0
+		}
+		if onDisk < f.Length {
+			first, last := t.pieceRange(offset+onDisk, offset+f.Length)
+			for index := first; index <= last; index++ {
+				missing[index] = true
+			}
+		}
+		offset += f.Length
+	}
+	for index := range t.PieceHashes {
+		if report.have.HasPiece(index) {
+			continue
+		}
+		if missing[index] {
+			report.Missing = append(report.Missing, index)
+		} else {
+			report.Corrupt = append(report.Corrupt, index)
+		}
+	}
+
+	offset = 0
+	for i, f := range info.Files {
+		fr := FileReport{
+			Path:    f.Path,
+			Missing: files[i].Length < 0,
+			Size:    files[i].Length,
+			Length:  f.Length,
+		}
+		if fr.Missing {
+			fr.Size = 0
+		}
+		if f.Length > 0 {
+			first, last := t.pieceRange(offset, offset+f.Length)
+			for index := first; index <= last; index++ {
+				if !report.have.HasPiece(index) {
+					fr.BadPieces = append(fr.BadPieces, index)
+				}
+			}
+		}
+		if fr.Missing || fr.Size != fr.Length || len(fr.BadPieces) > 0 {
+			report.Files = append(report.Files, fr)
+		}
+		offset += f.Length
+	}
+	return report, nil
+}
+
+// Repair downloads the pieces that a verification of the data at path
+// found missing or corrupt, keeping the others, until it is complete or
+// stop is closed
+func (t *TorrentFile) Repair(path string, report *VerifyReport, stop <-chan struct{}) error {
+	return t.downloadToFile(path, report.have, false, stop)
+}
+
+// pieceRange returns the first and last pieces holding bytes of the
+// torrent's data in [begin, end)
+func (t *TorrentFile) pieceRange(begin, end int64) (first, last int) {
+	first = int(begin / int64(t.PieceLength))
+	last = int((end - 1) / int64(t.PieceLength))
+	if last >= len(t.PieceHashes) {
+		last = len(t.PieceHashes) - 1
+	}
+	return first, last
+}
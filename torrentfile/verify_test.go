@@ -0,0 +1,152 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	// Pieces of 4 bytes across a.txt (6 bytes) and sub/b.txt (5 bytes):
+	// #0 is in a.txt, #1 straddles both files and #2 is in sub/b.txt
+	content := []byte("abcdefghijk")
+	tf := &TorrentFile{
+		Name:        "test",
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceLength: 4,
+		Length:      len(content),
+		Files: []File{
+			{Path: []string{"a.txt"}, Length: 6, Offset: 0},
+			{Path: []string{"sub", "b.txt"}, Length: 5, Offset: 6},
+		},
+	}
+	for i := 0; i < len(content); i += tf.PieceLength {
+		end := i + tf.PieceLength
+		if end > len(content) {
+			end = len(content)
+		}
+		tf.PieceHashes = append(tf.PieceHashes, sha1.Sum(content[i:end]))
+	}
+	bPath := filepath.Join("sub", "b.txt")
+
+	tests := map[string]struct {
+		a, b    string // file contents, "-" if missing
+		missing []int
+		corrupt []int
+		files   []FileReport
+	}{
+		"intact": {
+			a:       "abcdef",
+			b:       "ghijk",
+			missing: nil,
+			corrupt: nil,
+			files:   nil,
+		},
+		"corrupt byte": {
+			a:       "abcdef",
+			b:       "ghiXk",
+			missing: nil,
+			corrupt: []int{2},
+			files: []FileReport{
+				{Path: bPath, Size: 5, Length: 5, BadPieces: []int{2}},
+			},
+		},
+		"missing file": {
+			a:       "abcdef",
+			b:       "-",
+			missing: []int{1, 2},
+			corrupt: nil,
+			files: []FileReport{
+				{Path: "a.txt", Size: 6, Length: 6, BadPieces: []int{1}},
+				{Path: bPath, Missing: true, Size: 0, Length: 5, BadPieces: []int{1, 2}},
+			},
+		},
+		"short file": {
+			a:       "abc",
+			b:       "ghijk",
+			missing: []int{0, 1},
+			corrupt: nil,
+			files: []FileReport{
+				{Path: "a.txt", Size: 3, Length: 6, BadPieces: []int{0, 1}},
+				{Path: bPath, Size: 5, Length: 5, BadPieces: []int{1}},
+			},
+		},
+		"long file": {
+			a:       "abcdef",
+			b:       "ghijkl",
+			missing: nil,
+			corrupt: nil,
+			files: []FileReport{
+				{Path: bPath, Size: 6, Length: 5, BadPieces: nil},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		dir, err := ioutil.TempDir("", "verify")
+		require.Nil(t, err, name)
+		defer os.RemoveAll(dir)
+		require.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0755), name)
+		if test.a != "-" {
+			require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte(test.a), 0644), name)
+		}
+		if test.b != "-" {
+			require.Nil(t, ioutil.WriteFile(filepath.Join(dir, bPath), []byte(test.b), 0644), name)
+		}
+
+		report, err := tf.Verify(dir, 2)
+		require.Nil(t, err, name)
+		assert.Equal(t, 3, report.Pieces, name)
+		assert.Equal(t, test.missing, report.Missing, name)
+		assert.Equal(t, test.corrupt, report.Corrupt, name)
+		assert.Equal(t, test.files, report.Files, name)
+		assert.Equal(t, test.missing == nil && test.corrupt == nil, report.OK(), name)
+
+		// Verifying must leave the data as it was
+		_, err = os.Stat(filepath.Join(dir, bPath))
+		assert.Equal(t, test.b == "-", os.IsNotExist(err), name)
+		if test.a != "-" {
+			a, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+			require.Nil(t, err, name)
+			assert.Equal(t, test.a, string(a), name)
+		}
+	}
+}
+
+func TestPieceRange(t *testing.T) {
+	tf := &TorrentFile{PieceLength: 4, PieceHashes: make([][20]byte, 3)}
+	tests := map[string]struct {
+		begin, end  int64
+		first, last int
+	}{
+		"within a piece": {
+			begin: 1,
+			end:   3,
+			first: 0,
+			last:  0,
+		},
+		"piece boundaries": {
+			begin: 4,
+			end:   8,
+			first: 1,
+			last:  1,
+		},
+		"straddling pieces": {
+			begin: 3,
+			end:   10,
+			first: 0,
+			last:  2,
+		},
+	}
+
+	for name, test := range tests {
+		first, last := tf.pieceRange(test.begin, test.end)
+		assert.Equal(t, test.first, first, name)
+		assert.Equal(t, test.last, last, name)
+	}
+}